@@ -0,0 +1,100 @@
+package firewall
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/safing/portmaster/firewall/interception/capture"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+var (
+	captureDir              string
+	captureFilter           string
+	captureRotateSize       int64
+	captureRotateInterval   time.Duration
+	captureRingBuffer       bool
+	captureRingBufferFrames int
+
+	// captureEngine is the active capture Engine, or nil if capture is
+	// disabled (the default). Set once in initCapture and never replaced
+	// afterwards, so it may be read without a lock.
+	captureEngine *capture.Engine
+)
+
+func init() {
+	flag.StringVar(&captureDir, "capture-dir", "", "enable packet capture and write pcapng files to this directory")
+	flag.StringVar(&captureFilter, "capture-filter", "", "capture filter expression, eg. \"profile:<id>\" or \"tcp port 443\"")
+	flag.Int64Var(&captureRotateSize, "capture-rotate-size", 0, "rotate the current capture file once the packet data written to it reaches this many bytes (0 disables)")
+	flag.DurationVar(&captureRotateInterval, "capture-rotate-interval", 0, "rotate the current capture file after this long (0 disables)")
+	flag.BoolVar(&captureRingBuffer, "capture-ring-buffer", false, "only write buffered frames to disk once a triggering event (eg. block verdict) fires")
+	flag.IntVar(&captureRingBufferFrames, "capture-ring-buffer-frames", 0, "number of frames the ring buffer holds, if enabled")
+}
+
+// initCapture starts the packet capture engine if -capture-dir is set.
+// Capture is opt-in: with no directory configured, captureEngine stays nil
+// and tapCapture becomes a no-op.
+func initCapture() error {
+	if captureDir == "" {
+		return nil
+	}
+
+	engine, err := capture.NewEngine(capture.Config{
+		Dir:              captureDir,
+		RotateSize:       captureRotateSize,
+		RotateInterval:   captureRotateInterval,
+		RingBuffer:       captureRingBuffer,
+		RingBufferFrames: captureRingBufferFrames,
+		Filter:           captureFilter,
+	})
+	if err != nil {
+		return fmt.Errorf("firewall: failed to start capture engine: %w", err)
+	}
+
+	captureEngine = engine
+	return nil
+}
+
+func stopCapture() error {
+	if captureEngine == nil {
+		return nil
+	}
+	return captureEngine.Close()
+}
+
+// tapCapture feeds the packet and its resolved verdict to the capture
+// engine, if enabled. It is called from issueVerdict, the one place in the
+// firewall handler that sees a packet, its connection and its final
+// verdict together.
+func tapCapture(conn *network.Connection, pkt packet.Packet, verdict network.Verdict) {
+	if captureEngine == nil {
+		return
+	}
+
+	// Best-effort: load the packet's data if that hasn't happened yet. The
+	// error is ignored, so a packet whose data cannot be loaded is still
+	// tapped with whatever Layers().Data() holds.
+	_ = pkt.LoadPacketData()
+
+	direction := "outbound"
+	if pkt.IsInbound() {
+		direction = "inbound"
+	}
+
+	captureEngine.Tap(&capture.Frame{
+		Timestamp: time.Now(),
+		Data:      pkt.Layers().Data(),
+		Direction: direction,
+		Verdict:   verdict.String(),
+		ConnID:    conn.ID,
+		PID:       conn.Process().Pid,
+		Profile:   conn.ProcessContext.ProfileID,
+	})
+
+	switch verdict {
+	case network.VerdictBlock, network.VerdictDrop:
+		captureEngine.TriggerFlush("verdict: " + verdict.String())
+	}
+}
@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/safing/portbase/api"
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/interception/capture"
+)
+
+// captureUpgrader upgrades a live capture request to a WebSocket. The
+// endpoint is only reachable through the control API, which already
+// authenticates the request, so we don't need to restrict the origin here.
+var captureUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// registerCaptureAPI registers the live capture WebSocket endpoint. A
+// client attaches with eg. `wireshark -k -i <(curl ... /capture/live)` to
+// inspect traffic while Portmaster keeps running.
+func registerCaptureAPI() error {
+	return api.RegisterHandler("/api/v1/capture/live", http.HandlerFunc(handleCaptureLive))
+}
+
+// handleCaptureLive streams every Frame the capture engine taps, encoded as
+// pcapng, over a WebSocket for as long as the client stays connected. The
+// "filter" query parameter takes the same BPF/predicate expression as
+// -capture-filter.
+func handleCaptureLive(w http.ResponseWriter, r *http.Request) {
+	if captureEngine == nil {
+		http.Error(w, "capture is disabled, set -capture-dir to enable it", http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := capture.NewFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid filter: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := captureUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warningf("firewall: failed to upgrade live capture request: %s", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	var buf bytes.Buffer
+	frameWriter, err := capture.NewFrameWriter(&buf)
+	if err != nil {
+		log.Warningf("firewall: failed to start live capture stream: %s", err)
+		return
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		return
+	}
+
+	frames, cancel := captureEngine.Subscribe()
+	defer cancel()
+
+	for frame := range frames {
+		if !filter.Match(frame) {
+			continue
+		}
+
+		buf.Reset()
+		if err := frameWriter.WriteFrame(frame); err != nil {
+			log.Warningf("firewall: failed to encode live capture frame: %s", err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+			return
+		}
+	}
+}
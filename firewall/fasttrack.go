@@ -0,0 +1,164 @@
+package firewall
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/fasttrack"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+var fastTrackRulesFlag string
+
+func init() {
+	flag.StringVar(&fastTrackRulesFlag, "fasttrack-rules", "", "JSON-encoded list of additional FastTrackRule entries to seed on startup, on top of the built-in defaults")
+}
+
+// FastTrackRule and FastTrackDirection are re-exported from the fasttrack
+// package so callers only need to import the firewall package.
+type (
+	FastTrackRule      = fasttrack.Rule
+	FastTrackDirection = fasttrack.Direction
+)
+
+// FastTrackDirection values.
+const (
+	FastTrackAny      = fasttrack.Any
+	FastTrackInbound  = fasttrack.Inbound
+	FastTrackOutbound = fasttrack.Outbound
+)
+
+// fastTrackRules holds the user-configurable fast-track rules consulted by
+// fastTrackedPermit. It starts out seeded with the handful of carve-outs
+// that used to be hardcoded there and are expressible as plain CIDR rules.
+//
+// The DHCP, Portmaster-API and DNS carve-outs further down in
+// fastTrackedPermit stay as dedicated code instead of moving into this
+// ruleset: they key off runtime state (the locally detected network scope,
+// the dynamically assigned API IP, the configured nameserver matcher) that
+// a static CIDR/port rule cannot express. What moves here is exactly the
+// part that already was a fixed CIDR match.
+var fastTrackRules = fasttrack.NewSet()
+
+func init() {
+	defaults := []*fasttrack.Rule{
+		{
+			ID:        "default-blocked-ipv4",
+			CIDR:      "0.0.0.17/32",
+			Verdict:   network.VerdictBlock,
+			Permanent: true,
+		},
+		{
+			ID:        "default-blocked-ipv6",
+			CIDR:      "::17/128",
+			Verdict:   network.VerdictBlock,
+			Permanent: true,
+		},
+	}
+	for _, rule := range defaults {
+		if err := fastTrackRules.Insert(rule); err != nil {
+			// The CIDRs above are constants, so this can only mean a bug in
+			// this file.
+			panic("firewall: invalid default fast-track rule: " + err.Error())
+		}
+	}
+}
+
+// loadFastTrackRulesFromFlag seeds the ruleset with any rules passed via
+// -fasttrack-rules, in addition to the built-in defaults set up in init.
+func loadFastTrackRulesFromFlag() error {
+	if fastTrackRulesFlag == "" {
+		return nil
+	}
+
+	var rules []FastTrackRule
+	if err := json.Unmarshal([]byte(fastTrackRulesFlag), &rules); err != nil {
+		return fmt.Errorf("firewall: failed to parse -fasttrack-rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if err := AddFastTrackRule(rule); err != nil {
+			return fmt.Errorf("firewall: failed to add fast-track rule %q: %w", rule.ID, err)
+		}
+	}
+	return nil
+}
+
+// SetFastTrackRules replaces the entire fast-track ruleset with rules. The
+// swap is atomic: packets being classified concurrently see either the old
+// or the new ruleset in full, never a partial one.
+func SetFastTrackRules(rules []FastTrackRule) error {
+	ptrs := make([]*fasttrack.Rule, len(rules))
+	for i := range rules {
+		ptrs[i] = &rules[i]
+	}
+	if err := fastTrackRules.Replace(ptrs); err != nil {
+		return err
+	}
+	bumpVerdictCacheGeneration()
+	return nil
+}
+
+// AddFastTrackRule adds a single rule to the fast-track ruleset without
+// disturbing any other rule.
+func AddFastTrackRule(rule FastTrackRule) error {
+	if err := fastTrackRules.Insert(&rule); err != nil {
+		return err
+	}
+	bumpVerdictCacheGeneration()
+	return nil
+}
+
+// RemoveFastTrackRule removes the rule with the given id, if any, and
+// reports whether a rule was actually removed.
+func RemoveFastTrackRule(id string) bool {
+	removed := fastTrackRules.Remove(id)
+	if removed {
+		bumpVerdictCacheGeneration()
+	}
+	return removed
+}
+
+// applyFastTrackVerdict applies rule's verdict to pkt.
+func applyFastTrackVerdict(pkt packet.Packet, rule *fasttrack.Rule) {
+	var err error
+	switch rule.Verdict {
+	case network.VerdictBlock:
+		if rule.Permanent {
+			err = pkt.PermanentBlock()
+		} else {
+			err = pkt.Block()
+		}
+	case network.VerdictDrop:
+		if rule.Permanent {
+			err = pkt.PermanentDrop()
+		} else {
+			err = pkt.Drop()
+		}
+	default:
+		if rule.Permanent {
+			err = pkt.PermanentAccept()
+		} else {
+			err = pkt.Accept()
+		}
+	}
+
+	if err != nil {
+		log.Warningf("filter: failed to apply fast-track verdict for rule %s: %s", rule.ID, err)
+	}
+}
+
+// fastTrackRemoteIP returns the IP fastTrackRules should match against: the
+// destination for outbound packets, the source for inbound ones, mirroring
+// how a CIDR rule like "my LAN" is meant to apply regardless of which side
+// of the connection initiated it.
+func fastTrackRemoteIP(src, dst net.IP, inbound bool) net.IP {
+	if inbound {
+		return src
+	}
+	return dst
+}
@@ -0,0 +1,194 @@
+// Package fasttrack implements a dual-stack CIDR radix tree of
+// user-configurable fast-track rules, so the firewall can accept or drop
+// well-known traffic (eg. a trusted LAN subnet, or a known-bad CIDR) by an
+// O(k) longest-prefix-match lookup instead of running it through the full
+// connection decision process.
+package fasttrack
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Direction restricts a Rule to packets going only one way.
+type Direction uint8
+
+const (
+	// Any matches packets regardless of direction.
+	Any Direction = iota
+	// Inbound matches only inbound packets.
+	Inbound
+	// Outbound matches only outbound packets.
+	Outbound
+)
+
+// Rule is a single fast-track entry. A Rule matches a packet if the
+// packet's remote IP (the destination for outbound packets, the source for
+// inbound ones) falls within CIDR, and Protocols/Ports/Direction - each
+// optional - also match.
+type Rule struct {
+	// ID identifies the rule for later removal via Set.Remove. Callers are
+	// responsible for keeping it unique.
+	ID string
+	// CIDR is the network this rule matches, eg. "192.168.0.0/16".
+	CIDR string
+	// Protocols restricts the rule to these protocols. Empty matches any
+	// protocol.
+	Protocols []packet.IPProtocol
+	// PortMin and PortMax restrict the rule to a destination port range,
+	// inclusive on both ends. A zero/zero pair matches any port.
+	PortMin, PortMax uint16
+	// Direction restricts the rule to inbound or outbound packets. Any
+	// matches both.
+	Direction Direction
+	// Verdict is applied to a packet the rule matches.
+	Verdict network.Verdict
+	// Permanent, if true, applies Verdict permanently to the whole
+	// connection instead of packet-by-packet.
+	Permanent bool
+
+	ipNet *net.IPNet
+}
+
+// matches reports whether the rule applies to a packet with the given
+// protocol and destination port, travelling in the given direction.
+// CIDR matching is done separately by the tree lookup that found this
+// rule in the first place.
+func (r *Rule) matches(protocol packet.IPProtocol, dstPort uint16, inbound bool) bool {
+	switch r.Direction {
+	case Inbound:
+		if !inbound {
+			return false
+		}
+	case Outbound:
+		if inbound {
+			return false
+		}
+	}
+
+	if len(r.Protocols) > 0 {
+		found := false
+		for _, p := range r.Protocols {
+			if p == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.PortMin != 0 || r.PortMax != 0 {
+		if dstPort < r.PortMin || dstPort > r.PortMax {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Set holds the active fast-track rules, split into an IPv4 and an IPv6
+// radix tree. It is safe for concurrent use: Lookup takes a read lock so
+// packet classification is never blocked by another reader, while
+// Insert/Remove/Replace take a brief write lock to mutate the trees.
+type Set struct {
+	mu sync.RWMutex
+	v4 tree
+	v6 tree
+}
+
+// NewSet creates an empty Set.
+func NewSet() *Set {
+	return &Set{}
+}
+
+// Insert adds rule to the set. Rules are additive: inserting two rules with
+// the same CIDR keeps both, and Lookup evaluates them in insertion order
+// among rules sharing the most specific matching prefix.
+func (s *Set) Insert(rule *Rule) error {
+	ipNet, v4, err := parseCIDR(rule.CIDR)
+	if err != nil {
+		return err
+	}
+	rule.ipNet = ipNet
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v4 {
+		s.v4.insert(ipNet.IP, leadingOnes(ipNet), rule)
+	} else {
+		s.v6.insert(ipNet.IP, leadingOnes(ipNet), rule)
+	}
+	return nil
+}
+
+// Remove deletes every rule with the given id. It reports whether any rule
+// was found and removed.
+func (s *Set) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removedV4 := s.v4.remove(id)
+	removedV6 := s.v6.remove(id)
+	return removedV4 || removedV6
+}
+
+// Replace atomically swaps the whole rule set for rules. Unlike Insert,
+// which mutates the live trees under the write lock, Replace builds the new
+// trees first and only then swaps them in, so a bulk update (eg. pushing a
+// freshly downloaded blocklist) never leaves Lookup seeing a half-built
+// tree.
+func (s *Set) Replace(rules []*Rule) error {
+	next := NewSet()
+	for _, r := range rules {
+		if err := next.Insert(r); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.v4, s.v6 = next.v4, next.v6
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup finds the most specific rule whose CIDR contains remoteIP and
+// whose protocol/port/direction match, if any.
+func (s *Set) Lookup(remoteIP net.IP, protocol packet.IPProtocol, dstPort uint16, inbound bool) (*Rule, bool) {
+	match := func(r *Rule) bool {
+		return r.matches(protocol, dstPort, inbound)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if v4 := remoteIP.To4(); v4 != nil {
+		return s.v4.lookup(v4, 32, match)
+	}
+	return s.v6.lookup(remoteIP.To16(), 128, match)
+}
+
+func parseCIDR(cidr string) (ipNet *net.IPNet, v4 bool, err error) {
+	_, ipNet, err = net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, false, fmt.Errorf("fasttrack: invalid CIDR %q: %w", cidr, err)
+	}
+
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		ipNet.IP = ip4
+		return ipNet, true, nil
+	}
+	ipNet.IP = ipNet.IP.To16()
+	return ipNet, false, nil
+}
+
+func leadingOnes(ipNet *net.IPNet) int {
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
@@ -0,0 +1,104 @@
+package fasttrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestLookupLongestPrefixWins(t *testing.T) {
+	s := NewSet()
+
+	if err := s.Insert(&Rule{ID: "allow-lan", CIDR: "192.168.0.0/16", Verdict: network.VerdictAccept}); err != nil {
+		t.Fatalf("failed to insert allow-lan: %s", err)
+	}
+	if err := s.Insert(&Rule{ID: "deny-host", CIDR: "192.168.1.5/32", Verdict: network.VerdictDrop}); err != nil {
+		t.Fatalf("failed to insert deny-host: %s", err)
+	}
+
+	rule, ok := s.Lookup(net.IPv4(192, 168, 1, 5), packet.TCP, 443, false)
+	if !ok || rule.ID != "deny-host" {
+		t.Fatalf("expected the more specific deny-host rule to win, got %+v", rule)
+	}
+
+	rule, ok = s.Lookup(net.IPv4(192, 168, 1, 6), packet.TCP, 443, false)
+	if !ok || rule.ID != "allow-lan" {
+		t.Fatalf("expected the /16 allow-lan rule to match a sibling host, got %+v", rule)
+	}
+
+	if _, ok := s.Lookup(net.IPv4(8, 8, 8, 8), packet.TCP, 443, false); ok {
+		t.Error("expected no rule to match an address outside both CIDRs")
+	}
+}
+
+func TestLookupFiltersOnProtocolPortAndDirection(t *testing.T) {
+	s := NewSet()
+	err := s.Insert(&Rule{
+		ID:        "dhcp",
+		CIDR:      "10.0.0.0/8",
+		Protocols: []packet.IPProtocol{packet.UDP},
+		PortMin:   67,
+		PortMax:   68,
+		Direction: Outbound,
+		Verdict:   network.VerdictAccept,
+	})
+	if err != nil {
+		t.Fatalf("failed to insert dhcp rule: %s", err)
+	}
+
+	ip := net.IPv4(10, 1, 2, 3)
+
+	if _, ok := s.Lookup(ip, packet.TCP, 67, false); ok {
+		t.Error("expected rule restricted to UDP to not match TCP")
+	}
+	if _, ok := s.Lookup(ip, packet.UDP, 80, false); ok {
+		t.Error("expected rule restricted to ports 67-68 to not match port 80")
+	}
+	if _, ok := s.Lookup(ip, packet.UDP, 67, true); ok {
+		t.Error("expected rule restricted to outbound to not match an inbound packet")
+	}
+	if _, ok := s.Lookup(ip, packet.UDP, 67, false); !ok {
+		t.Error("expected rule to match a packet satisfying all its restrictions")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s := NewSet()
+	if err := s.Insert(&Rule{ID: "tmp", CIDR: "172.16.0.0/12", Verdict: network.VerdictAccept}); err != nil {
+		t.Fatalf("failed to insert rule: %s", err)
+	}
+
+	if !s.Remove("tmp") {
+		t.Fatal("expected Remove to report that it removed the rule")
+	}
+	if s.Remove("tmp") {
+		t.Error("expected a second Remove of the same id to report nothing removed")
+	}
+	if _, ok := s.Lookup(net.IPv4(172, 16, 1, 1), packet.TCP, 0, false); ok {
+		t.Error("expected removed rule to no longer match")
+	}
+}
+
+func TestReplaceIsAtomic(t *testing.T) {
+	s := NewSet()
+	if err := s.Insert(&Rule{ID: "old", CIDR: "1.2.3.0/24", Verdict: network.VerdictAccept}); err != nil {
+		t.Fatalf("failed to insert rule: %s", err)
+	}
+
+	err := s.Replace([]*Rule{
+		{ID: "new", CIDR: "4.5.6.0/24", Verdict: network.VerdictDrop},
+	})
+	if err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	if _, ok := s.Lookup(net.IPv4(1, 2, 3, 4), packet.TCP, 0, false); ok {
+		t.Error("expected old rule to be gone after Replace")
+	}
+	rule, ok := s.Lookup(net.IPv4(4, 5, 6, 7), packet.TCP, 0, false)
+	if !ok || rule.ID != "new" {
+		t.Fatalf("expected new rule to be active after Replace, got %+v", rule)
+	}
+}
@@ -0,0 +1,106 @@
+package fasttrack
+
+// node is one bit of a CIDR radix tree. A rule whose CIDR terminates at
+// this node's prefix length is appended to rules; children hold the two
+// possible next bits (0 and 1) of longer prefixes below this one.
+type node struct {
+	children [2]*node
+	rules    []*Rule
+}
+
+// tree is a single-stack (v4 or v6) CIDR radix tree. All methods assume the
+// caller already holds whatever lock guards concurrent access (see Set).
+type tree struct {
+	root *node
+}
+
+// insert adds rule at the node reached by following the first prefixLen
+// bits of addr, creating intermediate nodes as needed.
+func (t *tree) insert(addr []byte, prefixLen int, rule *Rule) {
+	if t.root == nil {
+		t.root = &node{}
+	}
+
+	n := t.root
+	for i := 0; i < prefixLen; i++ {
+		bit := bitAt(addr, i)
+		if n.children[bit] == nil {
+			n.children[bit] = &node{}
+		}
+		n = n.children[bit]
+	}
+	n.rules = append(n.rules, rule)
+}
+
+// remove deletes every rule with the given id from the tree, wherever its
+// prefix is. It reports whether any rule was removed.
+func (t *tree) remove(id string) bool {
+	return removeFromNode(t.root, id)
+}
+
+func removeFromNode(n *node, id string) bool {
+	if n == nil {
+		return false
+	}
+
+	removed := false
+	kept := n.rules[:0]
+	for _, r := range n.rules {
+		if r.ID == id {
+			removed = true
+			continue
+		}
+		kept = append(kept, r)
+	}
+	n.rules = kept
+
+	for _, c := range n.children {
+		if removeFromNode(c, id) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// lookup walks addr bit by bit, visiting up to maxBits nodes, and then
+// checks the rules at each visited node from the most-specific (deepest)
+// prefix to the least-specific, returning the first one for which match
+// reports true. This is the O(k) longest-prefix-match with fallback that
+// FastTrackRule lookups rely on: a /32 deny can coexist with a /8 allow
+// covering it, and the /32 always wins when it applies.
+func (t *tree) lookup(addr []byte, maxBits int, match func(*Rule) bool) (*Rule, bool) {
+	if t.root == nil {
+		return nil, false
+	}
+
+	path := make([]*node, 1, maxBits+1)
+	path[0] = t.root
+
+	n := t.root
+	for i := 0; i < maxBits; i++ {
+		bit := bitAt(addr, i)
+		next := n.children[bit]
+		if next == nil {
+			break
+		}
+		n = next
+		path = append(path, n)
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, r := range path[i].rules {
+			if match(r) {
+				return r, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// bitAt returns bit i of addr, counting from the most significant bit of
+// addr[0].
+func bitAt(addr []byte, i int) int {
+	byteIdx := i / 8
+	bitIdx := 7 - uint(i%8)
+	return int((addr[byteIdx] >> bitIdx) & 1)
+}
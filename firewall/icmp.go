@@ -0,0 +1,36 @@
+package firewall
+
+import (
+	"net"
+
+	"github.com/safing/portmaster/firewall/icmp"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// icmpTracker is the firewall's ICMP echo tracker, correlating echo
+// request/replies and ICMP errors with the connections they concern.
+var icmpTracker = icmp.NewTracker(icmp.DefaultTimeout)
+
+// icmpConnAdapter implements icmp.ConnectionHandler by delegating to the
+// firewall package's own connection handling, so the icmp package doesn't
+// need to import firewall back.
+type icmpConnAdapter struct{}
+
+func (icmpConnAdapter) GetConnection(pkt packet.Packet) (*network.Connection, error) {
+	return getConnection(pkt)
+}
+
+func (icmpConnAdapter) IssueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.Verdict, permanent bool) {
+	issueVerdict(conn, pkt, verdict, permanent)
+}
+
+func (icmpConnAdapter) DecideOnConnection(conn *network.Connection, pkt packet.Packet) {
+	DecideOnConnection(pkt.Ctx(), conn, pkt)
+	// Not permanent, so later echoes of this flow still reach the tracker.
+	issueVerdict(conn, pkt, 0, false)
+}
+
+func (icmpConnAdapter) LookupConnection(protocol packet.IPProtocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) (*network.Connection, bool) {
+	return lookupConnectionByTuple(protocol, srcIP, dstIP, srcPort, dstPort)
+}
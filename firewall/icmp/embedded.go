@@ -0,0 +1,114 @@
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// EmbeddedFlow is the original flow an ICMP "destination unreachable" or
+// "time exceeded" error refers to, recovered from the (partial) IP header
+// the error carries.
+type EmbeddedFlow struct {
+	Protocol packet.IPProtocol
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+
+	ipv4MinHeaderLen = 20
+	ipv6HeaderLen    = 40
+	l4PortsLen       = 4 // src port + dst port, 2 bytes each
+
+	// icmpv6ErrorMsgLen is the length of the message-specific field (eg.
+	// the "unused"/pointer/MTU field of destination-unreachable,
+	// time-exceeded and packet-too-big) that precedes the embedded
+	// original packet in an ICMPv6 error's payload. gopacket's
+	// layers.ICMPv6 base layer only decodes the fixed 4-byte type/code/
+	// checksum header, so unlike ICMPv4 - whose echo Id/Seq gopacket folds
+	// into its own 8-byte header, already consumed before LayerPayload -
+	// these 4 bytes are still at the front of LayerPayload() and must be
+	// skipped before the embedded IPv6 header starts.
+	icmpv6ErrorMsgLen = 4
+)
+
+// parseEmbeddedHeader recovers the original flow from data, the payload of
+// an ICMP(v6) error message. For IPv6, it assumes no extension headers are
+// present between the fixed header and the transport header, which holds
+// for the routers and stacks that generate these errors in practice.
+func parseEmbeddedHeader(data []byte, v6 bool) (EmbeddedFlow, error) {
+	if v6 {
+		return parseEmbeddedIPv6(data)
+	}
+	return parseEmbeddedIPv4(data)
+}
+
+func parseEmbeddedIPv4(data []byte) (EmbeddedFlow, error) {
+	if len(data) < ipv4MinHeaderLen {
+		return EmbeddedFlow{}, errors.New("icmp: embedded IPv4 header too short")
+	}
+
+	ihl := int(data[0]&0x0F) * 4
+	if ihl < ipv4MinHeaderLen {
+		return EmbeddedFlow{}, errors.New("icmp: embedded IPv4 header reports an invalid length")
+	}
+
+	flow := EmbeddedFlow{
+		Protocol: packet.IPProtocol(data[9]),
+		SrcIP:    net.IP(append([]byte(nil), data[12:16]...)),
+		DstIP:    net.IP(append([]byte(nil), data[16:20]...)),
+	}
+
+	if ports, ok := extractPorts(data, ihl, flow.Protocol); ok {
+		flow.SrcPort, flow.DstPort = ports[0], ports[1]
+	}
+	return flow, nil
+}
+
+func parseEmbeddedIPv6(data []byte) (EmbeddedFlow, error) {
+	if len(data) < icmpv6ErrorMsgLen {
+		return EmbeddedFlow{}, errors.New("icmp: embedded IPv6 header too short")
+	}
+	data = data[icmpv6ErrorMsgLen:]
+
+	if len(data) < ipv6HeaderLen {
+		return EmbeddedFlow{}, errors.New("icmp: embedded IPv6 header too short")
+	}
+
+	flow := EmbeddedFlow{
+		Protocol: packet.IPProtocol(data[6]),
+		SrcIP:    net.IP(append([]byte(nil), data[8:24]...)),
+		DstIP:    net.IP(append([]byte(nil), data[24:40]...)),
+	}
+
+	if ports, ok := extractPorts(data, ipv6HeaderLen, flow.Protocol); ok {
+		flow.SrcPort, flow.DstPort = ports[0], ports[1]
+	}
+	return flow, nil
+}
+
+// extractPorts reads the source/destination ports starting at offset, if
+// protocol is TCP or UDP and enough bytes are present. Both protocols put
+// the ports in the same first-four-bytes layout.
+func extractPorts(data []byte, offset int, protocol packet.IPProtocol) (ports [2]uint16, ok bool) {
+	switch uint8(protocol) {
+	case protocolTCP, protocolUDP:
+	default:
+		return ports, false
+	}
+
+	if len(data) < offset+l4PortsLen {
+		return ports, false
+	}
+
+	ports[0] = binary.BigEndian.Uint16(data[offset : offset+2])
+	ports[1] = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	return ports, true
+}
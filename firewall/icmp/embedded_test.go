@@ -0,0 +1,63 @@
+package icmp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseEmbeddedIPv4(t *testing.T) {
+	data := make([]byte, 28)
+	data[0] = 0x45 // version 4, IHL 5 (20 bytes)
+	data[9] = protocolUDP
+	copy(data[12:16], net.IPv4(10, 0, 0, 1).To4())
+	copy(data[16:20], net.IPv4(10, 0, 0, 2).To4())
+	data[20], data[21] = 0x1F, 0x90 // src port 8080
+	data[22], data[23] = 0x00, 0x35 // dst port 53
+
+	flow, err := parseEmbeddedHeader(data, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !flow.SrcIP.Equal(net.IPv4(10, 0, 0, 1)) || !flow.DstIP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("unexpected addresses: %+v", flow)
+	}
+	if flow.SrcPort != 8080 || flow.DstPort != 53 {
+		t.Errorf("unexpected ports: %+v", flow)
+	}
+}
+
+func TestParseEmbeddedIPv4TooShort(t *testing.T) {
+	if _, err := parseEmbeddedHeader(make([]byte, 10), false); err == nil {
+		t.Error("expected error for too-short embedded header")
+	}
+}
+
+func TestParseEmbeddedIPv6(t *testing.T) {
+	// The first 4 bytes are the message-specific field (eg. the "unused"
+	// field of destination-unreachable) that precedes the embedded header
+	// in LayerPayload() for every ICMPv6 error type - see icmpv6ErrorMsgLen.
+	data := make([]byte, icmpv6ErrorMsgLen+44)
+	hdr := data[icmpv6ErrorMsgLen:]
+	hdr[6] = protocolTCP
+	copy(hdr[8:24], net.ParseIP("2001:db8::1").To16())
+	copy(hdr[24:40], net.ParseIP("2001:db8::2").To16())
+	hdr[40], hdr[41] = 0x01, 0xBB // src port 443
+	hdr[42], hdr[43] = 0x00, 0x50 // dst port 80
+
+	flow, err := parseEmbeddedHeader(data, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !flow.SrcIP.Equal(net.ParseIP("2001:db8::1")) || !flow.DstIP.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("unexpected addresses: %+v", flow)
+	}
+	if flow.SrcPort != 443 || flow.DstPort != 80 {
+		t.Errorf("unexpected ports: %+v", flow)
+	}
+}
+
+func TestParseEmbeddedIPv6TooShort(t *testing.T) {
+	if _, err := parseEmbeddedHeader(make([]byte, 2), true); err == nil {
+		t.Error("expected error for too-short embedded header")
+	}
+}
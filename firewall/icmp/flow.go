@@ -0,0 +1,78 @@
+package icmp
+
+import (
+	"sync"
+	"time"
+)
+
+// ringSize is the number of outstanding echo sequences a flow remembers.
+// Anything sent before the oldest still-outstanding entry wraps around is
+// simply forgotten, rather than tracked forever.
+const ringSize = 16
+
+type pendingEcho struct {
+	seq  uint16
+	sent time.Time
+	used bool
+}
+
+// flow tracks one echo conversation identified by (local, remote, id): the
+// ring of sequence numbers sent but not yet answered, and running
+// sent/received counters.
+type flow struct {
+	mu       sync.Mutex
+	pending  [ringSize]pendingEcho
+	next     int
+	lastSeen time.Time
+
+	sent     uint64
+	received uint64
+}
+
+// recordRequest remembers that seq was just sent, overwriting whatever
+// occupied that ring slot - which, if it was still unanswered, counts as
+// lost.
+func (f *flow) recordRequest(seq uint16, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pending[f.next] = pendingEcho{seq: seq, sent: now, used: true}
+	f.next = (f.next + 1) % ringSize
+	f.lastSeen = now
+	f.sent++
+}
+
+// recordReply looks for seq among the outstanding requests and, if found,
+// returns the round-trip time and consumes the slot so the same reply
+// can't be matched twice.
+func (f *flow) recordReply(seq uint16, now time.Time) (rtt time.Duration, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastSeen = now
+
+	for i := range f.pending {
+		p := &f.pending[i]
+		if p.used && p.seq == seq {
+			p.used = false
+			f.received++
+			return now.Sub(p.sent), true
+		}
+	}
+	return 0, false
+}
+
+// idle reports whether the flow has seen no traffic for longer than
+// timeout, and is therefore eligible for eviction.
+func (f *flow) idle(now time.Time, timeout time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return now.Sub(f.lastSeen) > timeout
+}
+
+// stats returns the flow's running sent/received counters.
+func (f *flow) stats() (sent, received uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent, f.received
+}
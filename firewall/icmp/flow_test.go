@@ -0,0 +1,46 @@
+package icmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowRecordRequestReply(t *testing.T) {
+	f := &flow{}
+	now := time.Now()
+
+	f.recordRequest(1, now)
+	f.recordRequest(2, now.Add(time.Millisecond))
+
+	rtt, ok := f.recordReply(1, now.Add(10*time.Millisecond))
+	if !ok {
+		t.Fatal("expected reply for seq 1 to match")
+	}
+	if rtt != 10*time.Millisecond {
+		t.Errorf("expected rtt of 10ms, got %s", rtt)
+	}
+
+	if _, ok := f.recordReply(1, now.Add(20*time.Millisecond)); ok {
+		t.Error("expected seq 1 to not match twice")
+	}
+
+	if _, ok := f.recordReply(99, now); ok {
+		t.Error("expected unknown seq to not match")
+	}
+
+	sent, received := f.stats()
+	if sent != 2 || received != 1 {
+		t.Errorf("expected sent=2 received=1, got sent=%d received=%d", sent, received)
+	}
+}
+
+func TestFlowIdle(t *testing.T) {
+	f := &flow{lastSeen: time.Now()}
+
+	if f.idle(time.Now(), time.Minute) {
+		t.Error("expected fresh flow to not be idle")
+	}
+	if !f.idle(time.Now().Add(2*time.Minute), time.Minute) {
+		t.Error("expected flow untouched for 2 minutes to be idle after a 1 minute timeout")
+	}
+}
@@ -0,0 +1,73 @@
+package icmp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rttBucketsMs are the upper bounds, in milliseconds, of the RTT histogram
+// buckets. The last bucket catches everything above the largest edge.
+var rttBucketsMs = [...]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+
+// rttHistogram is a small fixed-bucket histogram of echo round-trip times.
+// It is intentionally self-contained rather than built on the portbase
+// metrics subsystem, which this package does not otherwise depend on.
+type rttHistogram struct {
+	mu      sync.Mutex
+	buckets [len(rttBucketsMs) + 1]uint64
+	count   uint64
+	sum     time.Duration
+}
+
+func (h *rttHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += d
+
+	ms := float64(d) / float64(time.Millisecond)
+	for i, edge := range rttBucketsMs {
+		if ms <= edge {
+			h.buckets[i]++
+			return
+		}
+	}
+	h.buckets[len(h.buckets)-1]++
+}
+
+// Stats is a snapshot of the tracker's echo counters and RTT distribution,
+// suitable for logging or exposing over the metrics subsystem.
+type Stats struct {
+	EchoesSent     uint64
+	EchoesReceived uint64
+	RTTSamples     uint64
+	MeanRTT        time.Duration
+	// RTTBuckets holds one cumulative-free count per bucket in rttBucketsMs,
+	// plus a trailing overflow bucket for RTTs above the largest edge.
+	RTTBuckets []uint64
+}
+
+func (h *rttHistogram) snapshot() (count uint64, mean time.Duration, buckets []uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count > 0 {
+		mean = h.sum / time.Duration(h.count)
+	}
+	buckets = append([]uint64(nil), h.buckets[:]...)
+	return h.count, mean, buckets
+}
+
+// Stats returns a snapshot of the tracker's echo metrics.
+func (t *Tracker) Stats() Stats {
+	count, mean, buckets := t.rtt.snapshot()
+	return Stats{
+		EchoesSent:     atomic.LoadUint64(&t.echoesSent),
+		EchoesReceived: atomic.LoadUint64(&t.echoesReceived),
+		RTTSamples:     count,
+		MeanRTT:        mean,
+		RTTBuckets:     buckets,
+	}
+}
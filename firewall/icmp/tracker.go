@@ -0,0 +1,239 @@
+// Package icmp is a first-class ICMP echo tracker and error correlator for
+// the firewall package. It keeps a per-(local, remote, id) flow of
+// outstanding echo sequences to match replies back to requests and compute
+// RTT/loss, and it recovers the original flow embedded in ICMP
+// "destination unreachable"/"time exceeded" errors so they can be attached
+// to the connection they actually concern.
+package icmp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// DefaultTimeout is how long a flow may go without traffic before the
+// eviction loop drops it, if the Tracker wasn't given a different timeout.
+const DefaultTimeout = 30 * time.Second
+
+// maxDiagnosticsPerConnection bounds how many ICMP error events are kept
+// per connection, so a router stuck sending time-exceeded messages can't
+// grow the diagnostics map without bound.
+const maxDiagnosticsPerConnection = 20
+
+// ConnectionHandler is how the Tracker reaches into the firewall package's
+// connection handling without the two packages importing each other.
+type ConnectionHandler interface {
+	// GetConnection returns the network.Connection for pkt, creating one if
+	// this is the first packet seen for its flow.
+	GetConnection(pkt packet.Packet) (*network.Connection, error)
+	// IssueVerdict applies verdict to pkt via conn, exactly as the rest of
+	// the firewall package's packet handling does.
+	IssueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.Verdict, permanent bool)
+	// DecideOnConnection runs conn through the same profile/rule decision
+	// process as any other connection and applies the resulting verdict to
+	// pkt, so eg. a profile that blocks ping is actually respected instead
+	// of echo traffic being accepted unconditionally.
+	DecideOnConnection(conn *network.Connection, pkt packet.Packet)
+	// LookupConnection finds the connection currently associated with the
+	// given 5-tuple, if any. Used to correlate an ICMP error back to the
+	// UDP/TCP connection it concerns.
+	LookupConnection(protocol packet.IPProtocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) (*network.Connection, bool)
+}
+
+// DiagnosticEvent records one ICMP error observed for a connection.
+type DiagnosticEvent struct {
+	Time time.Time
+	// Type is eg. "destination-unreachable" or "time-exceeded".
+	Type string
+	Code uint8
+	// From is the router or host that sent the ICMP error.
+	From net.IP
+}
+
+type flowKey struct {
+	local  [16]byte
+	remote [16]byte
+	id     uint16
+}
+
+// Tracker is a running ICMP echo tracker. Create one with NewTracker and
+// call Start before feeding it packets.
+type Tracker struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	flows map[flowKey]*flow
+
+	dmu         sync.Mutex
+	diagnostics map[string][]DiagnosticEvent
+
+	rtt            rttHistogram
+	echoesSent     uint64
+	echoesReceived uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTracker creates a Tracker that evicts idle flows after timeout. A
+// timeout of zero uses DefaultTimeout.
+func NewTracker(timeout time.Duration) *Tracker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Tracker{
+		timeout:     timeout,
+		flows:       make(map[flowKey]*flow),
+		diagnostics: make(map[string][]DiagnosticEvent),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start launches the background eviction loop. It must only be called
+// once.
+func (t *Tracker) Start() {
+	go t.evictionLoop()
+}
+
+// Stop shuts down the eviction loop and waits for it to exit.
+func (t *Tracker) Stop() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracker) evictionLoop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.evictIdleFlows()
+		}
+	}
+}
+
+func (t *Tracker) evictIdleFlows() {
+	now := time.Now()
+
+	t.mu.Lock()
+	for key, f := range t.flows {
+		if f.idle(now, t.timeout) {
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *Tracker) getOrCreateFlow(key flowKey) *flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.flows[key]
+	if !ok {
+		f = &flow{lastSeen: time.Now()}
+		t.flows[key] = f
+	}
+	return f
+}
+
+func newFlowKey(local, remote net.IP, id uint16) flowKey {
+	var key flowKey
+	key.id = id
+	copy(key.local[:], local.To16())
+	copy(key.remote[:], remote.To16())
+	return key
+}
+
+// HandleEcho updates the flow for an ICMP(v6) echo request or reply,
+// resolves (or creates) its network.Connection and runs it through the
+// normal decision process, exactly as any other connection - so profile
+// rules can still block ping, for example. It always reports handled=true:
+// once a packet has reached here, the tracker owns its fate, though the
+// verdict itself is decided exactly the same way it would be otherwise.
+func (t *Tracker) HandleEcho(handler ConnectionHandler, pkt packet.Packet, isRequest bool, id, seq uint16) (handled bool) {
+	meta := pkt.Info()
+
+	local, remote := meta.Src, meta.Dst
+	if pkt.IsInbound() {
+		local, remote = meta.Dst, meta.Src
+	}
+
+	f := t.getOrCreateFlow(newFlowKey(local, remote, id))
+
+	now := time.Now()
+	if isRequest {
+		f.recordRequest(seq, now)
+		atomic.AddUint64(&t.echoesSent, 1)
+	} else if rtt, ok := f.recordReply(seq, now); ok {
+		atomic.AddUint64(&t.echoesReceived, 1)
+		t.rtt.observe(rtt)
+	}
+
+	conn, err := handler.GetConnection(pkt)
+	if err != nil {
+		log.Debugf("icmp: failed to get connection for echo: %s", err)
+		_ = pkt.PermanentAccept()
+		return true
+	}
+
+	handler.DecideOnConnection(conn, pkt)
+	return true
+}
+
+// HandleError parses the embedded flow out of an ICMP "destination
+// unreachable"/"time exceeded" error's payload and, if it matches a
+// connection the firewall still knows about, records the error as a
+// diagnostic event on that connection. It reports whether the embedded
+// flow could be parsed at all; correlation itself is best-effort and never
+// causes the caller to treat the packet differently.
+func (t *Tracker) HandleError(handler ConnectionHandler, errType string, code uint8, from net.IP, embeddedPayload []byte, v6 bool) bool {
+	embedded, err := parseEmbeddedHeader(embeddedPayload, v6)
+	if err != nil {
+		log.Debugf("icmp: failed to parse embedded header of %s: %s", errType, err)
+		return false
+	}
+
+	conn, ok := handler.LookupConnection(embedded.Protocol, embedded.SrcIP, embedded.DstIP, embedded.SrcPort, embedded.DstPort)
+	if !ok {
+		return true
+	}
+
+	t.addDiagnostic(conn.ID, DiagnosticEvent{
+		Time: time.Now(),
+		Type: errType,
+		Code: code,
+		From: from,
+	})
+	return true
+}
+
+func (t *Tracker) addDiagnostic(connID string, event DiagnosticEvent) {
+	t.dmu.Lock()
+	defer t.dmu.Unlock()
+
+	events := append(t.diagnostics[connID], event)
+	if len(events) > maxDiagnosticsPerConnection {
+		events = events[len(events)-maxDiagnosticsPerConnection:]
+	}
+	t.diagnostics[connID] = events
+}
+
+// Diagnostics returns the ICMP error events recorded for the connection
+// with the given ID, oldest first.
+func (t *Tracker) Diagnostics(connID string) []DiagnosticEvent {
+	t.dmu.Lock()
+	defer t.dmu.Unlock()
+	return append([]DiagnosticEvent(nil), t.diagnostics[connID]...)
+}
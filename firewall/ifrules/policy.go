@@ -0,0 +1,191 @@
+// Package ifrules matches packets against interface-name-scoped firewall
+// policies, so the firewall can key a decision on the interface traffic
+// arrived on (eg. always trust "lo", block everything from a guest
+// bridge) rather than only on IP/port - a pattern common in VPN-style
+// firewalls.
+package ifrules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Policy is a single interface-scoped rule. A Policy applies to every
+// packet arriving on an interface matching its pattern, with
+// AllowedProtocols/PortMin/PortMax carving out exceptions that fall
+// through to the normal connection decision process instead.
+type Policy struct {
+	// DefaultVerdict is applied unconditionally to packets on a matching
+	// interface, unless they fall within the AllowedProtocols/PortMin-PortMax
+	// exception below.
+	DefaultVerdict network.Verdict
+	// Permanent, if true, applies DefaultVerdict permanently to the whole
+	// connection instead of packet-by-packet.
+	Permanent bool
+	// AllowedProtocols, together with PortMin/PortMax, exempts matching
+	// traffic from DefaultVerdict and lets it proceed to the normal
+	// decision process instead. Empty matches any protocol.
+	AllowedProtocols []packet.IPProtocol
+	// PortMin and PortMax restrict the exception to a destination port
+	// range, inclusive on both ends. A zero/zero pair matches any port. If
+	// AllowedProtocols and PortMin/PortMax are both left at their zero
+	// values, the policy carves out no exceptions at all and DefaultVerdict
+	// applies to every packet on the interface.
+	PortMin, PortMax uint16
+	// SkipInspection, if true, disables deep packet inspection for
+	// connections that fall through to the normal decision process because
+	// they matched an exception above.
+	SkipInspection bool
+	// Regex, if true, compiles the pattern this Policy is registered under
+	// (see Set.Replace) as a regular expression instead of a shell glob.
+	Regex bool
+}
+
+// hasExceptions reports whether p carves out any exception from its
+// DefaultVerdict.
+func (p *Policy) hasExceptions() bool {
+	return len(p.AllowedProtocols) > 0 || p.PortMin != 0 || p.PortMax != 0
+}
+
+// Exempt reports whether a packet with the given protocol and destination
+// port is exempted from p's DefaultVerdict and should proceed to the
+// normal connection decision process instead.
+func (p *Policy) Exempt(protocol packet.IPProtocol, dstPort uint16) bool {
+	if !p.hasExceptions() {
+		return false
+	}
+
+	if len(p.AllowedProtocols) > 0 {
+		found := false
+		for _, allowed := range p.AllowedProtocols {
+			if allowed == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if p.PortMin != 0 || p.PortMax != 0 {
+		if dstPort < p.PortMin || dstPort > p.PortMax {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compiledPolicy is a Policy together with the interface-name pattern it
+// was registered under, compiled into a matcher by Set.Replace.
+type compiledPolicy struct {
+	Policy
+	pattern string
+	matcher *regexp.Regexp
+}
+
+// Set holds the active interface policies, matched by compiling each
+// pattern into a regular expression once, at Replace time, rather than on
+// every lookup.
+type Set struct {
+	mu       sync.RWMutex
+	policies []*compiledPolicy
+}
+
+// NewSet creates an empty Set.
+func NewSet() *Set {
+	return &Set{}
+}
+
+// Replace atomically swaps the whole policy set for policies, keyed by
+// interface-name pattern. Patterns are evaluated in lexical order, so keep
+// them non-overlapping if more than one could match the same interface
+// name.
+func (s *Set) Replace(policies map[string]Policy) error {
+	patterns := make([]string, 0, len(policies))
+	for pattern := range policies {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	next := make([]*compiledPolicy, 0, len(patterns))
+	for _, pattern := range patterns {
+		policy := policies[pattern]
+
+		matcher, err := compilePattern(pattern, policy.Regex)
+		if err != nil {
+			return err
+		}
+
+		next = append(next, &compiledPolicy{
+			Policy:  policy,
+			pattern: pattern,
+			matcher: matcher,
+		})
+	}
+
+	s.mu.Lock()
+	s.policies = next
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup finds the first policy, in lexical pattern order, whose pattern
+// matches ifaceName.
+func (s *Set) Lookup(ifaceName string) (*Policy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.policies {
+		if p.matcher.MatchString(ifaceName) {
+			policy := p.Policy
+			return &policy, true
+		}
+	}
+	return nil, false
+}
+
+// compilePattern compiles pattern into a regular expression anchored to
+// match the whole interface name. If isRegex is true, pattern is compiled
+// as a regular expression as-is; otherwise it is treated as a shell glob,
+// where "*" and "?" are the only special characters.
+func compilePattern(pattern string, isRegex bool) (*regexp.Regexp, error) {
+	if isRegex {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("ifrules: invalid regex pattern %q: %w", pattern, err)
+		}
+		return re, nil
+	}
+
+	re, err := regexp.Compile("^" + globToRegex(pattern) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("ifrules: invalid glob pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// globToRegex translates a shell glob - where "*" matches any run of
+// characters and "?" matches exactly one - into the equivalent regular
+// expression, quoting everything else literally.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
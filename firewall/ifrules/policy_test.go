@@ -0,0 +1,101 @@
+package ifrules
+
+import (
+	"testing"
+
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+func TestLookupGlobPattern(t *testing.T) {
+	s := NewSet()
+	err := s.Replace(map[string]Policy{
+		"wg*": {DefaultVerdict: network.VerdictAccept},
+	})
+	if err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	if _, ok := s.Lookup("wg0"); !ok {
+		t.Error("expected wg0 to match glob pattern wg*")
+	}
+	if _, ok := s.Lookup("eth0"); ok {
+		t.Error("expected eth0 to not match glob pattern wg*")
+	}
+}
+
+func TestLookupRegexPattern(t *testing.T) {
+	s := NewSet()
+	err := s.Replace(map[string]Policy{
+		`wg[0-9]+`: {DefaultVerdict: network.VerdictAccept, Regex: true},
+	})
+	if err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	if _, ok := s.Lookup("wg0"); !ok {
+		t.Error("expected wg0 to match regex pattern wg[0-9]+")
+	}
+	if _, ok := s.Lookup("wgx"); ok {
+		t.Error("expected wgx to not match regex pattern wg[0-9]+")
+	}
+}
+
+func TestLookupLexicalOrderWinsOnOverlap(t *testing.T) {
+	s := NewSet()
+	err := s.Replace(map[string]Policy{
+		"*":      {DefaultVerdict: network.VerdictAccept},
+		"guest0": {DefaultVerdict: network.VerdictBlock},
+	})
+	if err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	// "*" sorts before "guest0" lexically, so it wins for any interface,
+	// including one that also matches the more specific pattern.
+	policy, ok := s.Lookup("guest0")
+	if !ok || policy.DefaultVerdict != network.VerdictAccept {
+		t.Fatalf("expected the lexically-first pattern to win, got %+v", policy)
+	}
+}
+
+func TestReplaceIsAtomic(t *testing.T) {
+	s := NewSet()
+	if err := s.Replace(map[string]Policy{"lo": {DefaultVerdict: network.VerdictAccept}}); err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	if err := s.Replace(map[string]Policy{"eth0": {DefaultVerdict: network.VerdictBlock}}); err != nil {
+		t.Fatalf("Replace returned error: %s", err)
+	}
+
+	if _, ok := s.Lookup("lo"); ok {
+		t.Error("expected old policy to be gone after Replace")
+	}
+	if _, ok := s.Lookup("eth0"); !ok {
+		t.Error("expected new policy to be active after Replace")
+	}
+}
+
+func TestExempt(t *testing.T) {
+	unrestricted := Policy{DefaultVerdict: network.VerdictBlock}
+	if unrestricted.Exempt(packet.UDP, 53) {
+		t.Error("expected a policy with no AllowedProtocols/ports to exempt nothing")
+	}
+
+	dnsOnly := Policy{
+		DefaultVerdict:   network.VerdictBlock,
+		AllowedProtocols: []packet.IPProtocol{packet.UDP},
+		PortMin:          53,
+		PortMax:          53,
+	}
+	if !dnsOnly.Exempt(packet.UDP, 53) {
+		t.Error("expected UDP/53 to be exempted by a DNS-only allow list")
+	}
+	if dnsOnly.Exempt(packet.TCP, 53) {
+		t.Error("expected TCP/53 to not be exempted by a UDP-only allow list")
+	}
+	if dnsOnly.Exempt(packet.UDP, 80) {
+		t.Error("expected UDP/80 to not be exempted by a port 53-only allow list")
+	}
+}
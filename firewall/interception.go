@@ -43,9 +43,6 @@ var (
 	packetsDropped  = new(uint64)
 	packetsFailed   = new(uint64)
 
-	blockedIPv4 = net.IPv4(0, 0, 0, 17)
-	blockedIPv6 = net.ParseIP("::17")
-
 	ownPID = os.Getpid()
 
 	streamManager = dpi.NewManager()
@@ -58,7 +55,11 @@ func init() {
 }
 
 func interceptionPrep() error {
-	return prepAPIAuth()
+	if err := prepAPIAuth(); err != nil {
+		return err
+	}
+
+	return registerCaptureAPI()
 }
 
 func interceptionStart() error {
@@ -68,6 +69,16 @@ func interceptionStart() error {
 
 	startAPIAuth()
 
+	if err := loadFastTrackRulesFromFlag(); err != nil {
+		return err
+	}
+
+	if err := initCapture(); err != nil {
+		return err
+	}
+
+	icmpTracker.Start()
+
 	interceptionModule.StartWorker("stat logger", statLogger)
 	interceptionModule.StartWorker("packet handler", packetHandler)
 
@@ -75,6 +86,12 @@ func interceptionStart() error {
 }
 
 func interceptionStop() error {
+	icmpTracker.Stop()
+
+	if err := stopCapture(); err != nil {
+		log.Warningf("firewall: failed to stop capture engine: %s", err)
+	}
+
 	return interception.Stop()
 }
 
@@ -101,6 +118,10 @@ func handlePacket(ctx context.Context, pkt packet.Packet) {
 		return
 	}
 
+	if verdictCacheApply(pkt) {
+		return
+	}
+
 	// Add context tracer and set context on packet.
 	traceCtx, tracer := log.AddTracer(ctx)
 	if tracer != nil {
@@ -172,9 +193,25 @@ func fastTrackedPermit(pkt packet.Packet) (handled bool) {
 		return true
 	}
 
-	// Check if connection was already blocked.
-	if meta.Dst.Equal(blockedIPv4) || meta.Dst.Equal(blockedIPv6) {
-		_ = pkt.PermanentBlock()
+	// Consult the user-configurable interface policies (eg. always trust
+	// "lo", block everything from a guest bridge). meta.Interface is the
+	// name of the interface the packet arrived on, populated by the NFQUEUE
+	// capture layer. A policy match whose allow-list doesn't exempt this
+	// packet is authoritative and short-circuits everything below.
+	if policy, ok := interfaceRules.Lookup(meta.Interface); ok && !policy.Exempt(meta.Protocol, meta.DstPort) {
+		log.Debugf("filter: interface policy for %q matched: %s", meta.Interface, pkt)
+		applyInterfaceVerdict(pkt, policy)
+		return true
+	}
+
+	// Consult the user-configurable fast-track rules (CIDR-based allow/deny
+	// lists, eg. a trusted LAN or a known-bad range). This also carries the
+	// permanently-blocked-IP carve-out that used to be hardcoded here.
+	inbound := pkt.IsInbound()
+	remoteIP := fastTrackRemoteIP(meta.Src, meta.Dst, inbound)
+	if rule, ok := fastTrackRules.Lookup(remoteIP, meta.Protocol, meta.DstPort, inbound); ok {
+		log.Debugf("filter: fast-track rule %q matched: %s", rule.ID, pkt)
+		applyFastTrackVerdict(pkt, rule)
 		return true
 	}
 
@@ -198,21 +235,41 @@ func fastTrackedPermit(pkt packet.Packet) (handled bool) {
 			return true
 		}
 
-		// Handle echo request and replies regularly.
-		// Other ICMP packets are considered system business.
+		// Echo requests and replies are handled by the ICMP tracker, which
+		// resolves them to a real connection and issues a proper verdict
+		// instead of the blanket accept below.
+		// Destination-unreachable and time-exceeded errors are correlated
+		// back to the connection they concern, but otherwise fall through to
+		// the blanket accept, same as before.
 		icmpLayers := pkt.Layers().LayerClass(layers.LayerClassIPControl)
 		switch icmpLayer := icmpLayers.(type) {
 		case *layers.ICMPv4:
 			switch icmpLayer.TypeCode.Type() {
-			case layers.ICMPv4TypeEchoRequest,
-				layers.ICMPv4TypeEchoReply:
-				return false
+			case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
+				return icmpTracker.HandleEcho(
+					icmpConnAdapter{}, pkt,
+					icmpLayer.TypeCode.Type() == layers.ICMPv4TypeEchoRequest,
+					icmpLayer.Id, icmpLayer.Seq,
+				)
+			case layers.ICMPv4TypeDestinationUnreachable:
+				icmpTracker.HandleError(icmpConnAdapter{}, "destination-unreachable", icmpLayer.TypeCode.Code(), meta.Src, icmpLayer.LayerPayload(), false)
+			case layers.ICMPv4TypeTimeExceeded:
+				icmpTracker.HandleError(icmpConnAdapter{}, "time-exceeded", icmpLayer.TypeCode.Code(), meta.Src, icmpLayer.LayerPayload(), false)
 			}
 		case *layers.ICMPv6:
 			switch icmpLayer.TypeCode.Type() {
-			case layers.ICMPv6TypeEchoRequest,
-				layers.ICMPv6TypeEchoReply:
-				return false
+			case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+				if echo, ok := pkt.Layers().Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo); ok {
+					return icmpTracker.HandleEcho(
+						icmpConnAdapter{}, pkt,
+						icmpLayer.TypeCode.Type() == layers.ICMPv6TypeEchoRequest,
+						echo.Identifier, echo.SeqNumber,
+					)
+				}
+			case layers.ICMPv6TypeDestinationUnreachable:
+				icmpTracker.HandleError(icmpConnAdapter{}, "destination-unreachable", icmpLayer.TypeCode.Code(), meta.Src, icmpLayer.LayerPayload(), true)
+			case layers.ICMPv6TypeTimeExceeded:
+				icmpTracker.HandleError(icmpConnAdapter{}, "time-exceeded", icmpLayer.TypeCode.Code(), meta.Src, icmpLayer.LayerPayload(), true)
 			}
 		}
 
@@ -362,6 +419,14 @@ func initialHandler(conn *network.Connection, pkt packet.Packet) {
 	log.Tracer(pkt.Ctx()).Trace("filter: starting decision process")
 	DecideOnConnection(pkt.Ctx(), conn, pkt)
 
+	// A connection that only reaches here because an interface policy's
+	// allow-list exempted it (see fastTrackedPermit) may still ask to skip
+	// inspection, eg. a narrow carve-out for an otherwise-blocked interface
+	// that shouldn't also pay the DPI cost.
+	if policy, ok := interfaceRules.Lookup(pkt.Info().Interface); ok && policy.SkipInspection {
+		conn.Inspecting = false
+	}
+
 	// tunneling
 	// TODO: add implementation for forced tunneling
 	if pkt.IsOutbound() &&
@@ -450,6 +515,9 @@ func issueVerdict(conn *network.Connection, pkt packet.Packet, verdict network.V
 		verdict = conn.Verdict
 	}
 
+	tapCapture(conn, pkt, verdict)
+	cacheVerdict(conn, pkt, verdict)
+
 	var err error
 	switch verdict {
 	case network.VerdictAccept:
@@ -534,6 +602,20 @@ func statLogger(ctx context.Context) error {
 			atomic.StoreUint64(packetsBlocked, 0)
 			atomic.StoreUint64(packetsDropped, 0)
 			atomic.StoreUint64(packetsFailed, 0)
+
+			log.Tracef(
+				"filter: verdict cache hits %d, misses %d",
+				atomic.LoadUint64(verdictCacheHits),
+				atomic.LoadUint64(verdictCacheMisses),
+			)
+			atomic.StoreUint64(verdictCacheHits, 0)
+			atomic.StoreUint64(verdictCacheMisses, 0)
+
+			icmpStats := icmpTracker.Stats()
+			log.Tracef(
+				"filter: icmp echoes sent %d, received %d, mean rtt %s",
+				icmpStats.EchoesSent, icmpStats.EchoesReceived, icmpStats.MeanRTT,
+			)
 		}
 	}
 }
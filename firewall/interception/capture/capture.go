@@ -0,0 +1,274 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/safing/portbase/log"
+)
+
+// Frame is one packet observed at the NFQUEUE layer, together with the
+// Portmaster-specific context a plain packet capture cannot provide.
+type Frame struct {
+	Timestamp time.Time
+	Data      []byte
+
+	Direction string // "inbound" or "outbound"
+	Verdict   string
+	ConnID    string
+	PID       int
+	Profile   string
+}
+
+func (f *Frame) comment() string {
+	return fmt.Sprintf(
+		"dir=%s verdict=%s conn=%s pid=%d profile=%s",
+		f.Direction, f.Verdict, f.ConnID, f.PID, f.Profile,
+	)
+}
+
+// Config configures a capture Engine.
+type Config struct {
+	// Dir is the directory pcapng files are written to.
+	Dir string
+	// RotateSize rotates the current file once the packet data written to
+	// it reaches this many bytes; pcapng block headers and comments are not
+	// counted. Zero disables size-based rotation.
+	RotateSize int64
+	// RotateInterval rotates the current file after this much time has
+	// passed. Zero disables time-based rotation.
+	RotateInterval time.Duration
+	// RingBuffer, if true, only flushes captured frames to disk once
+	// TriggerFlush is called for a frame currently held in the ring buffer.
+	// This bounds disk usage to interesting traffic while still capturing
+	// the moments leading up to it.
+	RingBuffer bool
+	// RingBufferFrames is the number of frames the ring buffer holds. Only
+	// used if RingBuffer is set.
+	RingBufferFrames int
+	// Filter is a BPF/predicate expression; see Filter.
+	Filter string
+}
+
+// Engine taps the packet stream and writes matching frames to rotating
+// pcapng files, and/or fans them out to live subscribers (eg. the capture
+// WebSocket API).
+type Engine struct {
+	cfg    Config
+	filter *Filter
+
+	mu           sync.Mutex
+	file         *os.File
+	writer       *ngWriter
+	bytesWritten int64
+	openedAt     time.Time
+
+	ring    []*Frame
+	ringPos int
+	ringLen int
+
+	subscribers map[chan *Frame]struct{}
+}
+
+// NewEngine creates a capture Engine from cfg. It does not open a file or
+// start writing until the first matching frame arrives.
+func NewEngine(cfg Config) (*Engine, error) {
+	filter, err := NewFilter(cfg.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RingBuffer && cfg.RingBufferFrames <= 0 {
+		cfg.RingBufferFrames = 1000
+	}
+
+	e := &Engine{
+		cfg:         cfg,
+		filter:      filter,
+		subscribers: make(map[chan *Frame]struct{}),
+	}
+	if cfg.RingBuffer {
+		e.ring = make([]*Frame, cfg.RingBufferFrames)
+	}
+
+	return e, nil
+}
+
+// Tap feeds one observed frame into the engine. Frames that do not match
+// the configured filter are dropped immediately.
+func (e *Engine) Tap(frame *Frame) {
+	if !e.filter.Match(frame) {
+		return
+	}
+
+	e.fanOut(frame)
+
+	if e.cfg.RingBuffer {
+		e.mu.Lock()
+		e.ring[e.ringPos] = frame
+		e.ringPos = (e.ringPos + 1) % len(e.ring)
+		if e.ringLen < len(e.ring) {
+			e.ringLen++
+		}
+		e.mu.Unlock()
+		return
+	}
+
+	if err := e.writeFrame(frame); err != nil {
+		log.Warningf("capture: failed to write frame: %s", err)
+	}
+}
+
+// TriggerFlush is called when an interesting event (block verdict, DNS
+// NXDOMAIN, SPN error, ...) happens, so the ring buffer - which up to now
+// only held frames in memory - gets written out, capturing the traffic
+// that led up to the event as well as the event itself.
+func (e *Engine) TriggerFlush(reason string) {
+	if !e.cfg.RingBuffer {
+		return
+	}
+
+	e.mu.Lock()
+	frames := make([]*Frame, 0, e.ringLen)
+	for i := 0; i < e.ringLen; i++ {
+		idx := (e.ringPos + len(e.ring) - e.ringLen + i) % len(e.ring)
+		if f := e.ring[idx]; f != nil {
+			frames = append(frames, f)
+		}
+	}
+	e.ringLen = 0
+	e.mu.Unlock()
+
+	if len(frames) == 0 {
+		return
+	}
+
+	log.Infof("capture: flushing %d buffered frames (trigger: %s)", len(frames), reason)
+	for _, f := range frames {
+		if err := e.writeFrame(f); err != nil {
+			log.Warningf("capture: failed to write buffered frame: %s", err)
+			return
+		}
+	}
+}
+
+// Subscribe registers ch to receive every frame the engine taps, matching
+// the filter, regardless of ring-buffer mode - used by the live capture
+// WebSocket endpoint. Call the returned cancel func to unsubscribe.
+func (e *Engine) Subscribe() (ch chan *Frame, cancel func()) {
+	ch = make(chan *Frame, 64)
+
+	e.mu.Lock()
+	e.subscribers[ch] = struct{}{}
+	e.mu.Unlock()
+
+	cancel = func() {
+		e.mu.Lock()
+		delete(e.subscribers, ch)
+		e.mu.Unlock()
+		close(ch)
+	}
+	return ch, cancel
+}
+
+func (e *Engine) fanOut(frame *Frame) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subscribers {
+		select {
+		case ch <- frame:
+		default:
+			// Slow subscriber - drop the frame rather than block capture.
+		}
+	}
+}
+
+func (e *Engine) writeFrame(frame *Frame) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.rotateIfNeededLocked(); err != nil {
+		return err
+	}
+	if e.writer == nil {
+		if err := e.openLocked(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.writer.writePacket(frame.Timestamp, frame.Data, frame.comment()); err != nil {
+		return err
+	}
+	e.bytesWritten += int64(len(frame.Data))
+	return nil
+}
+
+func (e *Engine) rotateIfNeededLocked() error {
+	if e.writer == nil {
+		return nil
+	}
+
+	sizeExceeded := e.cfg.RotateSize > 0 && e.bytesWritten >= e.cfg.RotateSize
+	timeExceeded := e.cfg.RotateInterval > 0 && time.Since(e.openedAt) >= e.cfg.RotateInterval
+	if !sizeExceeded && !timeExceeded {
+		return nil
+	}
+
+	return e.closeLocked()
+}
+
+func (e *Engine) openLocked() error {
+	if err := os.MkdirAll(e.cfg.Dir, 0o0700); err != nil {
+		return fmt.Errorf("capture: failed to create capture dir: %w", err)
+	}
+
+	name := fmt.Sprintf("portmaster-%s.pcapng", time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(e.cfg.Dir, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o0600)
+	if err != nil {
+		return fmt.Errorf("capture: failed to create %s: %w", path, err)
+	}
+
+	writer, err := newNgWriter(f)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("capture: failed to write pcapng header for %s: %w", path, err)
+	}
+
+	e.file = f
+	e.writer = writer
+	e.bytesWritten = 0
+	e.openedAt = time.Now()
+
+	log.Infof("capture: writing to %s", path)
+	return nil
+}
+
+func (e *Engine) closeLocked() error {
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	e.writer = nil
+	return err
+}
+
+// Close closes the current capture file, if any, and drops all live
+// subscribers. Frames still held in the ring buffer are not written out.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subscribers {
+		close(ch)
+		delete(e.subscribers, ch)
+	}
+
+	return e.closeLocked()
+}
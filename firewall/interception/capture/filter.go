@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// predicate matches a Portmaster-specific term of a capture filter, such as
+// "profile:<id>" or "verdict:block". Terms that are not recognized as a
+// predicate are instead handed to the BPF compiler, so a filter like
+// "profile:abcd tcp port 443" combines both.
+type predicate struct {
+	key   string
+	value string
+}
+
+// Filter combines a compiled BPF program (for standard packet-shape
+// matching) with Portmaster-specific predicates (for matching on context
+// that a BPF program cannot see, like which profile or verdict a packet
+// belongs to).
+type Filter struct {
+	bpf        *pcap.BPF
+	predicates []predicate
+}
+
+// NewFilter compiles expr into a Filter. expr may freely mix BPF syntax
+// (eg. "tcp port 443") with Portmaster predicates (eg. "profile:<id>",
+// "verdict:block"), separated by whitespace.
+func NewFilter(expr string) (*Filter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return &Filter{}, nil
+	}
+
+	var (
+		predicates []predicate
+		bpfTerms   []string
+	)
+
+	for _, term := range strings.Fields(expr) {
+		if key, value, ok := splitPredicate(term); ok {
+			predicates = append(predicates, predicate{key: key, value: value})
+			continue
+		}
+		bpfTerms = append(bpfTerms, term)
+	}
+
+	f := &Filter{predicates: predicates}
+
+	if len(bpfTerms) > 0 {
+		bpf, err := pcap.NewBPF(layers.LinkTypeRaw, 65535, strings.Join(bpfTerms, " "))
+		if err != nil {
+			return nil, fmt.Errorf("capture: invalid BPF filter %q: %w", strings.Join(bpfTerms, " "), err)
+		}
+		f.bpf = bpf
+	}
+
+	return f, nil
+}
+
+// splitPredicate recognizes "key:value" terms for the small set of
+// Portmaster-specific predicate keys. Anything else (including BPF terms
+// that contain a colon, such as IPv6 addresses) is left for the BPF
+// compiler.
+func splitPredicate(term string) (key, value string, ok bool) {
+	key, value, found := strings.Cut(term, ":")
+	if !found {
+		return "", "", false
+	}
+	switch key {
+	case "profile", "verdict":
+		return key, value, true
+	default:
+		return "", "", false
+	}
+}
+
+// Match reports whether the given frame passes the filter.
+func (f *Filter) Match(frame *Frame) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, p := range f.predicates {
+		switch p.key {
+		case "profile":
+			if frame.Profile != p.value {
+				return false
+			}
+		case "verdict":
+			if !strings.EqualFold(frame.Verdict, p.value) {
+				return false
+			}
+		}
+	}
+
+	if f.bpf != nil {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     frame.Timestamp,
+			CaptureLength: len(frame.Data),
+			Length:        len(frame.Data),
+		}
+		if !f.bpf.Matches(ci, frame.Data) {
+			return false
+		}
+	}
+
+	return true
+}
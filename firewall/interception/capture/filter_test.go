@@ -0,0 +1,55 @@
+package capture
+
+import "testing"
+
+func TestFilterPredicates(t *testing.T) {
+	f, err := NewFilter("profile:abcd verdict:block")
+	if err != nil {
+		t.Fatalf("NewFilter returned error: %s", err)
+	}
+
+	match := &Frame{Profile: "abcd", Verdict: "Block"}
+	if !f.Match(match) {
+		t.Error("expected frame matching both predicates to match")
+	}
+
+	wrongProfile := &Frame{Profile: "other", Verdict: "Block"}
+	if f.Match(wrongProfile) {
+		t.Error("expected frame with wrong profile to not match")
+	}
+
+	wrongVerdict := &Frame{Profile: "abcd", Verdict: "Accept"}
+	if f.Match(wrongVerdict) {
+		t.Error("expected frame with wrong verdict to not match")
+	}
+}
+
+func TestFilterEmptyMatchesEverything(t *testing.T) {
+	f, err := NewFilter("")
+	if err != nil {
+		t.Fatalf("NewFilter returned error: %s", err)
+	}
+
+	if !f.Match(&Frame{}) {
+		t.Error("expected empty filter to match everything")
+	}
+
+	var nilFilter *Filter
+	if !nilFilter.Match(&Frame{}) {
+		t.Error("expected nil filter to match everything")
+	}
+}
+
+func TestFilterBPFCombinesWithPredicates(t *testing.T) {
+	f, err := NewFilter("profile:abcd tcp")
+	if err != nil {
+		t.Fatalf("NewFilter returned error: %s", err)
+	}
+
+	if len(f.predicates) != 1 || f.predicates[0].key != "profile" {
+		t.Fatalf("expected exactly one profile predicate, got %+v", f.predicates)
+	}
+	if f.bpf == nil {
+		t.Error("expected remaining terms to be compiled as a BPF filter")
+	}
+}
@@ -0,0 +1,162 @@
+// Package capture taps the packet stream Portmaster intercepts at the
+// NFQUEUE layer and writes it out as pcapng, annotated with the
+// Portmaster-specific context (direction, verdict, connection ID, process
+// PID) that plain packet captures do not have, so operators can inspect why
+// a connection was blocked or misclassified without guessing from raw
+// bytes alone.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types, see the pcapng specification
+// (https://ietf-opsawg-wg.github.io/draft-ietf-opsawg-pcap/draft-ietf-opsawg-pcapng.html).
+const (
+	blockTypeSectionHeader = 0x0A0D0D0A
+	blockTypeInterfaceDesc = 0x00000001
+	blockTypeEnhancedPacket = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEndOfOpt = 0
+	optComment  = 1
+
+	linkTypeRaw = 101 // LINKTYPE_RAW: no link layer, starts with the IP header.
+)
+
+// ngWriter is a minimal pcapng writer that, unlike gopacket/pcapgo's
+// NgWriter, supports attaching an opt_comment to each Enhanced Packet
+// Block - which is how we surface Portmaster's per-packet context
+// (direction/verdict/connection ID/PID) directly in Wireshark.
+type ngWriter struct {
+	w io.Writer
+}
+
+func newNgWriter(w io.Writer) (*ngWriter, error) {
+	nw := &ngWriter{w: w}
+	if err := nw.writeSectionHeader(); err != nil {
+		return nil, err
+	}
+	if err := nw.writeInterfaceDescription(); err != nil {
+		return nil, err
+	}
+	return nw, nil
+}
+
+func (nw *ngWriter) writeSectionHeader() error {
+	buf := make([]byte, 28)
+	binary.LittleEndian.PutUint32(buf[0:4], blockTypeSectionHeader)
+	binary.LittleEndian.PutUint32(buf[4:8], 28) // block total length
+	binary.LittleEndian.PutUint32(buf[8:12], byteOrderMagic)
+	binary.LittleEndian.PutUint16(buf[12:14], 1) // major version
+	binary.LittleEndian.PutUint16(buf[14:16], 0) // minor version
+	binary.LittleEndian.PutUint64(buf[16:24], 0xFFFFFFFFFFFFFFFF) // section length: unknown
+	binary.LittleEndian.PutUint32(buf[24:28], 28)                 // block total length (again)
+	_, err := nw.w.Write(buf)
+	return err
+}
+
+func (nw *ngWriter) writeInterfaceDescription() error {
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(buf[0:4], blockTypeInterfaceDesc)
+	binary.LittleEndian.PutUint32(buf[4:8], 20) // block total length
+	binary.LittleEndian.PutUint16(buf[8:10], linkTypeRaw)
+	binary.LittleEndian.PutUint16(buf[10:12], 0) // reserved
+	binary.LittleEndian.PutUint32(buf[12:16], 0) // snaplen: unlimited
+	binary.LittleEndian.PutUint32(buf[16:20], 20)
+	_, err := nw.w.Write(buf)
+	return err
+}
+
+// writePacket writes one Enhanced Packet Block for data, with comment as
+// its opt_comment option so it shows up in Wireshark's packet details.
+func (nw *ngWriter) writePacket(ts time.Time, data []byte, comment string) error {
+	optionBytes := encodeCommentOption(comment)
+
+	// header(28: excludes the trailing total-length word which is
+	// accounted for separately) + data (padded to 4 bytes) + options + 4
+	dataPad := pad4(len(data))
+	length := 28 + len(data) + dataPad + len(optionBytes) + 4
+
+	buf := make([]byte, 28)
+	binary.LittleEndian.PutUint32(buf[0:4], blockTypeEnhancedPacket)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(length))
+	binary.LittleEndian.PutUint32(buf[8:12], 0) // interface id
+
+	us := uint64(ts.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(us>>32))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(us))
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(len(data))) // captured length
+	binary.LittleEndian.PutUint32(buf[24:28], uint32(len(data))) // original length
+
+	if _, err := nw.w.Write(buf); err != nil {
+		return err
+	}
+	if _, err := nw.w.Write(data); err != nil {
+		return err
+	}
+	if dataPad > 0 {
+		if _, err := nw.w.Write(make([]byte, dataPad)); err != nil {
+			return err
+		}
+	}
+	if _, err := nw.w.Write(optionBytes); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trailer, uint32(length))
+	_, err := nw.w.Write(trailer)
+	return err
+}
+
+func encodeCommentOption(comment string) []byte {
+	if comment == "" {
+		return nil
+	}
+
+	value := []byte(comment)
+	valuePad := pad4(len(value))
+
+	buf := make([]byte, 4+len(value)+valuePad+4)
+	binary.LittleEndian.PutUint16(buf[0:2], optComment)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(len(value)))
+	copy(buf[4:], value)
+	binary.LittleEndian.PutUint16(buf[4+len(value)+valuePad:], optEndOfOpt)
+	binary.LittleEndian.PutUint16(buf[4+len(value)+valuePad+2:], 0)
+	return buf
+}
+
+func pad4(n int) int {
+	if r := n % 4; r != 0 {
+		return 4 - r
+	}
+	return 0
+}
+
+// FrameWriter encodes Frames as pcapng onto an arbitrary io.Writer, using
+// the same Enhanced Packet Block + opt_comment encoding as the Engine's own
+// capture files. It is exported for the live capture API endpoint, which
+// streams Frames to a remote client (eg. over a WebSocket) instead of to a
+// file.
+type FrameWriter struct {
+	nw *ngWriter
+}
+
+// NewFrameWriter creates a FrameWriter and immediately writes the pcapng
+// section header and interface description to w.
+func NewFrameWriter(w io.Writer) (*FrameWriter, error) {
+	nw, err := newNgWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameWriter{nw: nw}, nil
+}
+
+// WriteFrame writes one Enhanced Packet Block for frame.
+func (fw *FrameWriter) WriteFrame(frame *Frame) error {
+	return fw.nw.writePacket(frame.Timestamp, frame.Data, frame.comment())
+}
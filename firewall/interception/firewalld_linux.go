@@ -0,0 +1,203 @@
+package interception
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/safing/portbase/log"
+)
+
+const (
+	firewalldBusName    = "org.fedoraproject.FirewallD1"
+	firewalldObjectPath = "/org/fedoraproject/FirewallD1"
+	firewalldIface      = "org.fedoraproject.FirewallD1"
+
+	// firewalldConfigObjectPath/firewalldConfigDirectIface are the
+	// permanent configuration counterparts of firewalldObjectPath's
+	// runtime direct interface. Rules added via direct.passthrough on the
+	// runtime object are themselves wiped by `firewall-cmd --reload`, same
+	// as any other unmanaged rule; addPassthrough on the config object
+	// instead writes them into firewalld's permanent config, so firewalld
+	// re-installs them itself on every reload and start.
+	firewalldConfigObjectPath  = "/org/fedoraproject/FirewallD1/config"
+	firewalldConfigDirectIface = "org.fedoraproject.FirewallD1.config.direct"
+)
+
+var disableFirewalldCooperation bool
+
+func init() {
+	flag.BoolVar(
+		&disableFirewalldCooperation,
+		"disable-firewalld-cooperation",
+		false,
+		"do not cooperate with firewalld: neither re-apply rules on reload, nor register them via config.direct.addPassthrough",
+	)
+}
+
+// firewalldWatcher re-applies Portmaster's netfilter rules whenever
+// firewalld reloads, since a `firewall-cmd --reload` flushes any raw
+// iptables/nftables chains that were not installed through firewalld
+// itself.
+type firewalldWatcher struct {
+	conn    *dbus.Conn
+	signals chan *dbus.Signal
+	done    chan struct{}
+}
+
+// startFirewalldCooperation detects a running firewalld via D-Bus and, if
+// found, starts watching for reloads and registers Portmaster's rules as
+// firewalld passthrough rules so they survive reloads even if Portmaster is
+// not fast enough to reinstall them itself.
+//
+// It is not an error for firewalld to be absent - this simply does nothing
+// in that case.
+func startFirewalldCooperation() (*firewalldWatcher, error) {
+	if disableFirewalldCooperation {
+		return nil, nil
+	}
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		log.Debugf("interception: could not connect to system bus, skipping firewalld cooperation: %s", err)
+		return nil, nil
+	}
+
+	if !firewalldIsRunning(conn) {
+		return nil, nil
+	}
+
+	log.Infof("interception: detected firewalld, enabling cooperation")
+
+	if err := registerPassthroughRules(conn); err != nil {
+		log.Warningf("interception: failed to register rules with firewalld config.direct.addPassthrough: %s", err)
+	}
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface(firewalldIface),
+		dbus.WithMatchMember("Reloaded"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to firewalld Reloaded signal: %w", err)
+	}
+
+	fw := &firewalldWatcher{
+		conn:    conn,
+		signals: make(chan *dbus.Signal, 4),
+		done:    make(chan struct{}),
+	}
+	conn.Signal(fw.signals)
+
+	go fw.watch()
+
+	return fw, nil
+}
+
+func firewalldIsRunning(conn *dbus.Conn) bool {
+	var hasOwner bool
+	err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, firewalldBusName).Store(&hasOwner)
+	return err == nil && hasOwner
+}
+
+func (fw *firewalldWatcher) watch() {
+	for {
+		select {
+		case <-fw.done:
+			return
+		case sig, ok := <-fw.signals:
+			if !ok {
+				return
+			}
+			if sig.Name != firewalldIface+".Reloaded" {
+				continue
+			}
+
+			log.Infof("interception: firewalld reloaded, re-applying netfilter rules")
+			if err := activateNfqueueFirewall(); err != nil {
+				log.Warningf("interception: failed to re-apply netfilter rules after firewalld reload: %s", err)
+				continue
+			}
+			if err := registerPassthroughRules(fw.conn); err != nil {
+				log.Warningf("interception: failed to re-register rules with firewalld after reload: %s", err)
+			}
+		}
+	}
+}
+
+func (fw *firewalldWatcher) stop() {
+	if fw == nil {
+		return
+	}
+	close(fw.done)
+	fw.conn.RemoveSignal(fw.signals)
+}
+
+// registerPassthroughRules registers Portmaster's chains and jump rules
+// with firewalld's permanent configuration via config.direct.addPassthrough,
+// so firewalld itself re-installs them on every `firewall-cmd --reload` (and
+// on firewalld's own start), instead of depending solely on Portmaster
+// noticing the Reloaded signal in time. addPassthrough is idempotent -
+// registering an already-present rule is not an error - so this is safe to
+// call again from the Reloaded handler.
+func registerPassthroughRules(conn *dbus.Conn) error {
+	obj := conn.Object(firewalldBusName, firewalldConfigObjectPath)
+
+	rules := passthroughRules()
+	for _, rule := range rules {
+		call := obj.Call(firewalldConfigDirectIface+".addPassthrough", 0, rule.ipv, rule.args)
+		if call.Err != nil {
+			return fmt.Errorf("addPassthrough(%v) failed: %w", rule.args, call.Err)
+		}
+	}
+
+	return nil
+}
+
+type passthroughRule struct {
+	ipv  string
+	args []string
+}
+
+// passthroughRules mirrors the chain-creation rules from v4chains/v6chains
+// and every v4once/v6once entry (the top-level jumps into the chains and the
+// nat OUTPUT DNAT redirects) as firewalld direct rules. The actual
+// NFQUEUE/CONNMARK rules inside the C170/C171/C17 chains are still
+// programmed by Portmaster's own NetfilterRunner and are not registered
+// with firewalld.
+func passthroughRules() []passthroughRule {
+	var rules []passthroughRule
+
+	for _, chain := range v4chains {
+		rules = append(rules, passthroughRule{ipv: "ipv4", args: chainCreateArgs(chain)})
+	}
+	for _, rule := range v4once {
+		rules = append(rules, passthroughRule{ipv: "ipv4", args: onceInsertArgs(rule)})
+	}
+	for _, chain := range v6chains {
+		rules = append(rules, passthroughRule{ipv: "ipv6", args: chainCreateArgs(chain)})
+	}
+	for _, rule := range v6once {
+		rules = append(rules, passthroughRule{ipv: "ipv6", args: onceInsertArgs(rule)})
+	}
+
+	return rules
+}
+
+// chainCreateArgs turns a "table chain" entry (from v4chains/v6chains) into
+// the iptables-style argument list firewalld's direct.passthrough expects
+// to create that chain.
+func chainCreateArgs(entry string) []string {
+	parts := strings.Split(entry, " ")
+	return []string{"-t", parts[0], "-N", parts[1]}
+}
+
+// onceInsertArgs turns a "table chain ..." entry (from v4once/v6once) into
+// the iptables-style argument list firewalld's direct.passthrough expects
+// to insert that rule at the top of the (base) chain.
+func onceInsertArgs(entry string) []string {
+	parts := strings.Split(entry, " ")
+	args := []string{"-t", parts[0], "-I", parts[1], "1"}
+	return append(args, parts[2:]...)
+}
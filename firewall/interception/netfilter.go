@@ -0,0 +1,128 @@
+package interception
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/safing/portbase/log"
+)
+
+// Family selects the IP family a NetfilterRunner operation applies to.
+// Portmaster's rule tables are entirely separate per family (v4rules vs
+// v6rules in nfqueue_linux.go), so every operation that touches a table or
+// chain needs to say which one it means instead of silently hitting both.
+type Family uint8
+
+// Family values.
+const (
+	FamilyIPv4 Family = 4
+	FamilyIPv6 Family = 6
+)
+
+// NetfilterRunner abstracts the underlying packet filtering backend used to
+// hook Portmaster's NFQUEUE chains and NAT redirects into the kernel. This
+// lets us support both the legacy iptables binaries and, where the kernel
+// and userspace tooling support it, nftables directly - which is required
+// on distros that no longer ship the legacy iptables binaries (RHEL 9,
+// Debian 12, Fedora, ...).
+type NetfilterRunner interface {
+	// EnsureChain creates the given chain in family if it does not exist
+	// yet, and flushes it if it does, so callers can rebuild it from
+	// scratch.
+	EnsureChain(family Family, table, chain string) error
+	// AppendRule appends a rule to the end of table/chain in family. spec
+	// follows the same argument style as iptables, eg. []string{"-m",
+	// "mark", "--mark", "0", "-j", "DROP"}.
+	AppendRule(family Family, table, chain string, spec ...string) error
+	// InsertOnce inserts a rule at the top of table/chain in family, unless
+	// an equivalent rule is already present.
+	InsertOnce(family Family, table, chain string, spec ...string) error
+	// DeleteRule removes a rule from table/chain in family if it is
+	// present. It is not an error if no matching rule exists.
+	DeleteRule(family Family, table, chain string, spec ...string) error
+	// ClearAndDeleteChain flushes and then removes the given chain in
+	// family. It is not an error if the chain does not exist.
+	ClearAndDeleteChain(family Family, table, chain string) error
+	// AddNATRedirect installs a DNAT redirect in the nat table for packets
+	// carrying the given mark, redirecting protocol traffic to the given
+	// "host:port" (or "[host]:port" for IPv6) destination. The family it
+	// applies to is inferred from the form of to.
+	AddNATRedirect(mark int, protocol string, to string) error
+	// RemoveNATRedirect removes the DNAT redirect previously installed by
+	// AddNATRedirect with the same arguments. It is not an error if no
+	// matching redirect exists. Unlike DeleteRule, this only ever touches
+	// the specific redirect Portmaster itself installed, never the
+	// surrounding nat/OUTPUT chain as a whole - that chain is a kernel
+	// built-in shared with every other program's DNAT rules on the
+	// iptables backend.
+	RemoveNATRedirect(mark int, protocol string, to string) error
+	// TeardownBaseChains removes any base hook chains the backend created
+	// of its own (as opposed to the kernel's shared built-in chains, which
+	// callers un-hook from via DeleteRule instead). It is a no-op for
+	// backends, such as iptables, that only ever jump out of built-in
+	// chains and never own one.
+	TeardownBaseChains(family Family) error
+}
+
+var (
+	forceNetfilterBackend string
+)
+
+func init() {
+	flag.StringVar(
+		&forceNetfilterBackend,
+		"netfilter-backend",
+		"",
+		`force the netfilter backend used for packet interception ("iptables" or "nftables"); leave empty to auto-detect`,
+	)
+}
+
+// newNetfilterRunner selects and returns the NetfilterRunner backend to use,
+// either because it was forced via the -netfilter-backend flag, or by
+// probing the system for nftables support.
+func newNetfilterRunner() (NetfilterRunner, error) {
+	switch forceNetfilterBackend {
+	case "nftables":
+		log.Infof("interception: netfilter backend forced to nftables")
+		return newNftablesRunner()
+	case "iptables":
+		log.Infof("interception: netfilter backend forced to iptables")
+		return newIptablesRunner()
+	case "":
+		// Auto-detect below.
+	default:
+		log.Warningf("interception: unknown -netfilter-backend %q, auto-detecting instead", forceNetfilterBackend)
+	}
+
+	if systemUsesNftables() {
+		log.Infof("interception: detected nftables-based system, using nftables backend")
+		return newNftablesRunner()
+	}
+
+	log.Infof("interception: using legacy iptables backend")
+	return newIptablesRunner()
+}
+
+// systemUsesNftables reports whether rules should be programmed via
+// nftables directly. It returns true if the `iptables` binary is a symlink
+// whose target names the iptables-nft compatibility shim (as shipped by
+// default on RHEL 9, Debian 12, Fedora and recent Ubuntu releases);
+// otherwise, including when there is no `iptables` binary at all, it
+// returns true whenever the kernel's nftables socket is usable.
+func systemUsesNftables() bool {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		// No legacy binary at all - fall back to nftables if the kernel
+		// socket is available.
+		return nftablesSocketAvailable()
+	}
+
+	resolved, err := os.Readlink(path)
+	if err == nil && (strings.Contains(resolved, "xtables-nft-multi") || strings.Contains(resolved, "iptables-nft")) {
+		return true
+	}
+
+	return nftablesSocketAvailable()
+}
@@ -0,0 +1,135 @@
+package interception
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// iptablesRunner implements NetfilterRunner on top of the legacy
+// coreos/go-iptables bindings. It drives both the IPv4 and IPv6 tables, as
+// separate handles, so every call must say which one a given rule belongs
+// to instead of applying to both.
+type iptablesRunner struct {
+	v4 *iptables.IPTables
+	v6 *iptables.IPTables
+}
+
+func newIptablesRunner() (NetfilterRunner, error) {
+	v4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("interception: failed to init iptables (v4): %w", err)
+	}
+
+	v6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, fmt.Errorf("interception: failed to init iptables (v6): %w", err)
+	}
+
+	return &iptablesRunner{v4: v4, v6: v6}, nil
+}
+
+// tblFor returns the *iptables.IPTables handle for the given family.
+func (r *iptablesRunner) tblFor(family Family) *iptables.IPTables {
+	if family == FamilyIPv6 {
+		return r.v6
+	}
+	return r.v4
+}
+
+func (r *iptablesRunner) EnsureChain(family Family, table, chain string) error {
+	// ClearChain creates the chain if it does not exist yet, and flushes it
+	// if it does - which is exactly the semantics we want here.
+	return r.tblFor(family).ClearChain(table, chain)
+}
+
+func (r *iptablesRunner) AppendRule(family Family, table, chain string, spec ...string) error {
+	return r.tblFor(family).Append(table, chain, spec...)
+}
+
+func (r *iptablesRunner) InsertOnce(family Family, table, chain string, spec ...string) error {
+	tbl := r.tblFor(family)
+	ok, err := tbl.Exists(table, chain, spec...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return tbl.Insert(table, chain, 1, spec...)
+	}
+	return nil
+}
+
+func (r *iptablesRunner) DeleteRule(family Family, table, chain string, spec ...string) error {
+	tbl := r.tblFor(family)
+	ok, err := tbl.Exists(table, chain, spec...)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return tbl.Delete(table, chain, spec...)
+	}
+	return nil
+}
+
+func (r *iptablesRunner) ClearAndDeleteChain(family Family, table, chain string) error {
+	tbl := r.tblFor(family)
+	// Ignore errors from ClearChain/DeleteChain if the chain is already
+	// gone - this is expected during cleanup of a partial state.
+	_ = tbl.ClearChain(table, chain)
+	_ = tbl.DeleteChain(table, chain)
+	return nil
+}
+
+// TeardownBaseChains is a no-op for iptables: Portmaster never creates its
+// own base chains here, only jumps out of the kernel's shared built-in
+// OUTPUT/INPUT chains, which are un-hooked rule-by-rule via DeleteRule
+// instead of by clearing the whole (shared) chain.
+func (r *iptablesRunner) TeardownBaseChains(family Family) error {
+	return nil
+}
+
+// natRedirectSpec builds the DNAT rule spec AddNATRedirect/RemoveNATRedirect
+// both operate on, and the table handle it belongs to. v6 redirect targets
+// are written as "[addr]:port", matching how the existing v6once rule set
+// addresses them.
+func (r *iptablesRunner) natRedirectSpec(mark int, protocol string, to string) (*iptables.IPTables, []string) {
+	spec := []string{
+		"-m", "mark", "--mark", strconv.Itoa(mark),
+		"-p", protocol,
+		"-j", "DNAT", "--to", to,
+	}
+
+	tbl := r.v4
+	if strings.HasPrefix(to, "[") {
+		tbl = r.v6
+	}
+	return tbl, spec
+}
+
+func (r *iptablesRunner) AddNATRedirect(mark int, protocol string, to string) error {
+	tbl, spec := r.natRedirectSpec(mark, protocol, to)
+
+	ok, err := tbl.Exists("nat", "OUTPUT", spec...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return tbl.Insert("nat", "OUTPUT", 1, spec...)
+	}
+	return nil
+}
+
+func (r *iptablesRunner) RemoveNATRedirect(mark int, protocol string, to string) error {
+	tbl, spec := r.natRedirectSpec(mark, protocol, to)
+
+	ok, err := tbl.Exists("nat", "OUTPUT", spec...)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return tbl.Delete("nat", "OUTPUT", spec...)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package interception
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/safing/portbase/log"
+)
+
+// nftablesTable is the name of the dedicated table Portmaster creates in
+// both the ip and ip6 families, mirroring the "mangle C170/C171" and
+// "filter C17" chains the iptables backend uses.
+const nftablesTable = "portmaster"
+
+// nftablesRunner implements NetfilterRunner directly on top of
+// google/nftables, for systems where the legacy iptables binaries are
+// unavailable or merely emulated through nft.
+//
+// It accepts the same iptables-style rule specs as iptablesRunner (eg.
+// []string{"-m", "mark", "--mark", "0", "-j", "DROP"}) and translates the
+// small, fixed vocabulary Portmaster actually uses into nftables
+// expressions, so the rule tables in nfqueue_linux.go do not need to be
+// duplicated per backend.
+type nftablesRunner struct {
+	mu sync.Mutex
+
+	conn    *nftables.Conn
+	tables  map[nftables.TableFamily]*nftables.Table
+	chains  map[string]*nftables.Chain // keyed by "family/table/chain"
+	natOnce map[string]bool
+}
+
+func newNftablesRunner() (NetfilterRunner, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("interception: failed to connect to nftables: %w", err)
+	}
+
+	r := &nftablesRunner{
+		conn:    conn,
+		tables:  make(map[nftables.TableFamily]*nftables.Table),
+		chains:  make(map[string]*nftables.Chain),
+		natOnce: make(map[string]bool),
+	}
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		r.tables[family] = r.conn.AddTable(&nftables.Table{
+			Name:   nftablesTable,
+			Family: family,
+		})
+	}
+
+	if err := r.conn.Flush(); err != nil {
+		return nil, fmt.Errorf("interception: failed to create nftables tables: %w", err)
+	}
+
+	return r, nil
+}
+
+// nftablesSocketAvailable reports whether the running kernel exposes an
+// nftables netlink socket at all, which is the minimum requirement for the
+// nftables backend to function.
+func nftablesSocketAvailable() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTables()
+	return err == nil
+}
+
+// nftFamily maps a Family to the corresponding nftables.TableFamily.
+func nftFamily(family Family) nftables.TableFamily {
+	if family == FamilyIPv6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+// natChainName translates a logical chain name as used by Portmaster's rule
+// tables into the real chain name InsertOnce/getOrCreateChain use for the
+// nat table, so lookups by both always agree.
+func natChainName(table, chain string) string {
+	if table == "nat" {
+		return "nat-" + chain
+	}
+	return chain
+}
+
+// getOrCreateChain returns the chain for one of Portmaster's logical chain
+// names, adding it on first use: "OUTPUT", "INPUT" and "nat-OUTPUT" become
+// the base chains mangle-output, mangle-input and nat-output with the nft
+// type/hook they need, any other name a regular chain with no hook that is
+// only jumped to. Chains are cached under the logical name.
+func (r *nftablesRunner) getOrCreateChain(family nftables.TableFamily, name string) *nftables.Chain {
+	key := fmt.Sprintf("%d/%s", family, name)
+	if c, ok := r.chains[key]; ok {
+		return c
+	}
+
+	tbl := r.tables[family]
+
+	var chain *nftables.Chain
+	switch name {
+	case "OUTPUT":
+		hook := nftables.ChainHookOutput
+		prio := nftables.ChainPriorityMangle
+		chain = r.conn.AddChain(&nftables.Chain{
+			Name:     "mangle-output",
+			Table:    tbl,
+			Type:     nftables.ChainTypeRoute,
+			Hooknum:  hook,
+			Priority: &prio,
+		})
+	case "INPUT":
+		hook := nftables.ChainHookInput
+		prio := nftables.ChainPriorityMangle
+		chain = r.conn.AddChain(&nftables.Chain{
+			Name:     "mangle-input",
+			Table:    tbl,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hook,
+			Priority: &prio,
+		})
+	case "nat-OUTPUT":
+		hook := nftables.ChainHookOutput
+		prio := nftables.ChainPriorityNATDest
+		chain = r.conn.AddChain(&nftables.Chain{
+			Name:     "nat-output",
+			Table:    tbl,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  hook,
+			Priority: &prio,
+		})
+	default:
+		// Non-base chain (C170/C171/C17): only ever reached via a jump, so
+		// it needs no hook of its own.
+		chain = r.conn.AddChain(&nftables.Chain{
+			Name:  name,
+			Table: tbl,
+		})
+	}
+
+	r.chains[key] = chain
+	return chain
+}
+
+func (r *nftablesRunner) EnsureChain(family Family, table, chain string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.getOrCreateChain(nftFamily(family), chain)
+	r.conn.FlushChain(c)
+	return r.conn.Flush()
+}
+
+// AppendRule translates a small, known set of iptables-style specs used by
+// Portmaster's own rule tables into nftables expressions.
+func (r *nftablesRunner) AppendRule(family Family, table, chain string, spec ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exprs, err := translateSpec(spec)
+	if err != nil {
+		return fmt.Errorf("interception(nft): %s/%s: %w", table, chain, err)
+	}
+	nf := nftFamily(family)
+	r.conn.AddRule(&nftables.Rule{
+		Table: r.tables[nf],
+		Chain: r.getOrCreateChain(nf, chain),
+		Exprs: exprs,
+	})
+	return r.conn.Flush()
+}
+
+// InsertOnce inserts a jump rule ("-j C170" style) at the top of a base
+// chain, unless it (functionally) already exists. Since nftables has no
+// direct equivalent of iptables' -C existence check, we key on
+// family/table/chain/spec and only ever insert once per runner lifetime:
+// when activateNfqueueFirewall runs again (eg. after a firewalld reload),
+// rules inserted before are not inserted a second time.
+func (r *nftablesRunner) InsertOnce(family Family, table, chain string, spec ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := fmt.Sprintf("%d/%s/%s/%s", family, table, chain, strings.Join(spec, " "))
+	if r.natOnce[key] {
+		return nil
+	}
+
+	exprs, err := translateSpec(spec)
+	if err != nil {
+		return fmt.Errorf("interception(nft): %s/%s: %w", table, chain, err)
+	}
+
+	nf := nftFamily(family)
+	r.conn.InsertRule(&nftables.Rule{
+		Table: r.tables[nf],
+		Chain: r.getOrCreateChain(nf, natChainName(table, chain)),
+		Exprs: exprs,
+	})
+	r.natOnce[key] = true
+	return r.conn.Flush()
+}
+
+func (r *nftablesRunner) DeleteRule(family Family, table, chain string, spec ...string) error {
+	// nftables rules are identified by handle, not by content, and we do
+	// not track handles for individual rules here - ClearAndDeleteChain
+	// (which drops the whole chain) is what StateManager/Deactivate uses
+	// for cleanup instead. A no-op keeps the interface satisfied for
+	// callers that only ever delete whole chains.
+	log.Debugf("interception(nft): DeleteRule is a no-op, use ClearAndDeleteChain for %s/%s", table, chain)
+	return nil
+}
+
+func (r *nftablesRunner) ClearAndDeleteChain(family Family, table, chain string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nf := nftFamily(family)
+	// Chains are cached under the logical name getOrCreateChain was called
+	// with ("nat-OUTPUT" for the nat table) - translate the same way
+	// InsertOnce does so this finds the chain that was created. A chain this
+	// runner did not create itself (eg. one left by a previous run) is
+	// addressed by its real nft name.
+	realName := natChainName(table, chain)
+	key := fmt.Sprintf("%d/%s", nf, realName)
+	c, ok := r.chains[key]
+	if !ok {
+		nftName := realName
+		switch realName {
+		case "OUTPUT":
+			nftName = "mangle-output"
+		case "INPUT":
+			nftName = "mangle-input"
+		case "nat-OUTPUT":
+			nftName = "nat-output"
+		}
+		c = &nftables.Chain{Name: nftName, Table: r.tables[nf]}
+	}
+	r.conn.FlushChain(c)
+	r.conn.DelChain(c)
+	delete(r.chains, key)
+	return r.conn.Flush()
+}
+
+// TeardownBaseChains removes the dedicated mangle-output/mangle-input/
+// nat-output base hook chains this backend creates in getOrCreateChain.
+// Unlike iptables, which only ever jumps out of or redirects within the
+// kernel's shared OUTPUT/INPUT/nat-OUTPUT chains, these are chains
+// nftablesRunner owns outright within its own "portmaster" table, so they
+// must be explicitly flushed and deleted - they are never reached via the
+// logical "C17x" chain names teardownRuleSet already clears, nor via
+// RemoveNATRedirect, which only removes individual rules from nat-OUTPUT.
+func (r *nftablesRunner) TeardownBaseChains(family Family) error {
+	if err := r.ClearAndDeleteChain(family, "mangle", "OUTPUT"); err != nil {
+		return err
+	}
+	if err := r.ClearAndDeleteChain(family, "mangle", "INPUT"); err != nil {
+		return err
+	}
+	return r.ClearAndDeleteChain(family, "nat", "OUTPUT")
+}
+
+// natRedirectExprs builds the nftables expressions and table family for a
+// DNAT redirect of mark/protocol traffic to to, shared by
+// AddNATRedirect/RemoveNATRedirect so a removal always matches the exact
+// rule a corresponding add installed.
+func natRedirectExprs(mark int, protocol string, to string) (nftables.TableFamily, []expr.Any, error) {
+	host, portStr, err := net.SplitHostPort(to)
+	if err != nil {
+		return 0, nil, fmt.Errorf("interception(nft): invalid NAT target %q: %w", to, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("interception(nft): invalid NAT port %q: %w", portStr, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0, nil, fmt.Errorf("interception(nft): invalid NAT host %q", host)
+	}
+
+	family := nftables.TableFamilyIPv4
+	var l3proto uint32 = unix.NFPROTO_IPV4
+	addr := ip.To4()
+	if addr == nil {
+		family = nftables.TableFamilyIPv6
+		l3proto = unix.NFPROTO_IPV6
+		addr = ip.To16()
+	}
+
+	var l4proto uint8
+	switch protocol {
+	case "tcp":
+		l4proto = unix.IPPROTO_TCP
+	case "udp":
+		l4proto = unix.IPPROTO_UDP
+	default:
+		return 0, nil, fmt.Errorf("interception(nft): unsupported NAT protocol %q", protocol)
+	}
+
+	exprs := []expr.Any{
+		// meta mark == <mark>
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+		// meta l4proto == tcp/udp
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		// immediate: load redirect address/port into registers and DNAT
+		&expr.Immediate{Register: 1, Data: addr},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      l3proto,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	}
+	return family, exprs, nil
+}
+
+func (r *nftablesRunner) AddNATRedirect(mark int, protocol string, to string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	family, exprs, err := natRedirectExprs(mark, protocol, to)
+	if err != nil {
+		return err
+	}
+
+	r.conn.AddRule(&nftables.Rule{
+		Table: r.tables[family],
+		Chain: r.getOrCreateChain(family, "nat-OUTPUT"),
+		Exprs: exprs,
+	})
+	return r.conn.Flush()
+}
+
+// RemoveNATRedirect removes the specific DNAT rule AddNATRedirect installed
+// for mark/protocol/to, without touching any other rule in the nat-OUTPUT
+// chain (eg. another redirect for a different mark). nftables identifies
+// rules by handle rather than content, so the rule is first looked up by
+// re-deriving the same expressions AddNATRedirect would have installed and
+// matching them against what the kernel currently holds.
+func (r *nftablesRunner) RemoveNATRedirect(mark int, protocol string, to string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	family, exprs, err := natRedirectExprs(mark, protocol, to)
+	if err != nil {
+		return err
+	}
+
+	tbl := r.tables[family]
+	chain := r.getOrCreateChain(family, "nat-OUTPUT")
+
+	rules, err := r.conn.GetRule(tbl, chain)
+	if err != nil {
+		return fmt.Errorf("interception(nft): failed to list nat-OUTPUT rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if reflect.DeepEqual(rule.Exprs, exprs) {
+			if err := r.conn.DelRule(rule); err != nil {
+				return err
+			}
+			return r.conn.Flush()
+		}
+	}
+
+	// Already gone - consistent with DeleteRule's "not an error" contract.
+	return nil
+}
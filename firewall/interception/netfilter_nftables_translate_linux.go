@@ -0,0 +1,130 @@
+package interception
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// translateSpec turns one of Portmaster's iptables-style rule specs (see
+// v4rules/v6rules in nfqueue_linux.go) into the equivalent nftables
+// expressions. Only the small vocabulary Portmaster itself emits is
+// supported - this is not a general purpose iptables-to-nftables
+// translator.
+func translateSpec(spec []string) ([]expr.Any, error) {
+	var (
+		exprs      []expr.Any
+		markFilter uint32
+		haveMark   bool
+	)
+
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case "-m":
+			// "-m mark --mark <value>" - the only match module we emit.
+			if i+3 >= len(spec) || spec[i+1] != "mark" || spec[i+2] != "--mark" {
+				return nil, fmt.Errorf("unsupported match %q", spec[i+1])
+			}
+			value, err := strconv.ParseUint(spec[i+3], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mark value %q: %w", spec[i+3], err)
+			}
+			markFilter = uint32(value)
+			haveMark = true
+			i += 3
+
+		case "-j":
+			if i+1 >= len(spec) {
+				return nil, fmt.Errorf("dangling -j")
+			}
+
+			if haveMark {
+				exprs = append(exprs,
+					&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(markFilter)},
+				)
+				haveMark = false
+			}
+
+			target := spec[i+1]
+			rest := spec[i+2:]
+			targetExprs, consumed, err := translateTarget(target, rest)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, targetExprs...)
+			i += 1 + consumed
+
+		default:
+			return nil, fmt.Errorf("unsupported spec token %q", spec[i])
+		}
+	}
+
+	return exprs, nil
+}
+
+// translateTarget translates the "-j <TARGET> [args...]" tail of a rule
+// spec, returning the expressions for it plus the number of extra tokens
+// (beyond the target name itself) it consumed from args.
+func translateTarget(target string, args []string) ([]expr.Any, int, error) {
+	switch target {
+	case "DROP":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}, 0, nil
+	case "RETURN":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}, 0, nil
+	case "ACCEPT":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}, 0, nil
+	case "REJECT":
+		// "--reject-with <icmp-code>" is cosmetic for our purposes; nft
+		// picks a sensible default rejection message per address family.
+		consumed := 0
+		if len(args) >= 2 && args[0] == "--reject-with" {
+			consumed = 2
+		}
+		return []expr.Any{&expr.Reject{}}, consumed, nil
+	case "CONNMARK":
+		switch {
+		case len(args) >= 1 && args[0] == "--restore-mark":
+			return []expr.Any{
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			}, 1, nil
+		case len(args) >= 1 && args[0] == "--save-mark":
+			return []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+			}, 1, nil
+		default:
+			return nil, 0, fmt.Errorf("unsupported CONNMARK args %v", args)
+		}
+	case "NFQUEUE":
+		// "--queue-num <n> --queue-bypass"
+		if len(args) < 2 || args[0] != "--queue-num" {
+			return nil, 0, fmt.Errorf("unsupported NFQUEUE args %v", args)
+		}
+		qid, err := strconv.ParseUint(args[1], 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid queue-num %q: %w", args[1], err)
+		}
+		consumed := 2
+		bypass := uint8(0)
+		if len(args) >= 3 && args[2] == "--queue-bypass" {
+			bypass = 1
+			consumed = 3
+		}
+		return []expr.Any{&expr.Queue{
+			Num:  uint16(qid),
+			Flag: expr.QueueFlag(bypass),
+		}}, consumed, nil
+	default:
+		// Anything else is a jump to one of Portmaster's own chains (eg.
+		// "mangle OUTPUT -j C170"), which the base-chain hooks use to
+		// dispatch into the C17x chains set up by getOrCreateChain. The
+		// target name is used as-is rather than validated against a known
+		// set; applyRuleSet creates these chains via EnsureChain before any
+		// rule jumps to them.
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: target}}, 0, nil
+	}
+}
@@ -3,10 +3,11 @@ package interception
 import (
 	"flag"
 	"fmt"
+	"net"
 	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/safing/portbase/log"
@@ -34,6 +35,13 @@ var (
 	shutdownSignal = make(chan struct{})
 
 	experimentalNfqueueBackend bool
+
+	// netfilter is the active NetfilterRunner backend, selected in
+	// StartNfqueueInterception.
+	netfilter NetfilterRunner
+
+	// firewalld is non-nil while cooperating with a detected firewalld.
+	firewalld *firewalldWatcher
 )
 
 func init() {
@@ -128,102 +136,137 @@ func init() {
 }
 
 func activateNfqueueFirewall() error {
-	if err := activateIPTables(iptables.ProtocolIPv4, v4rules, v4once, v4chains); err != nil {
+	if err := applyRuleSet(netfilter, FamilyIPv4, v4rules, v4once, v4chains); err != nil {
 		return err
 	}
 
-	if err := activateIPTables(iptables.ProtocolIPv6, v6rules, v6once, v6chains); err != nil {
+	if err := applyRuleSet(netfilter, FamilyIPv6, v6rules, v6once, v6chains); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// DeactivateNfqueueFirewall drops portmaster related IP tables rules.
+// DeactivateNfqueueFirewall drops portmaster related netfilter rules.
 // Any errors encountered accumulated into a *multierror.Error.
 func DeactivateNfqueueFirewall() error {
-	// IPv4
 	var result *multierror.Error
-	if err := deactivateIPTables(iptables.ProtocolIPv4, v4once, v4chains); err != nil {
+
+	if err := teardownRuleSet(netfilter, FamilyIPv4, v4once, v4chains); err != nil {
 		result = multierror.Append(result, err)
 	}
 
-	// IPv6
-	if err := deactivateIPTables(iptables.ProtocolIPv6, v6once, v6chains); err != nil {
+	if err := teardownRuleSet(netfilter, FamilyIPv6, v6once, v6chains); err != nil {
 		result = multierror.Append(result, err)
 	}
 
 	return result.ErrorOrNil()
 }
 
-func activateIPTables(protocol iptables.Protocol, rules, once, chains []string) error {
-	tbls, err := iptables.NewWithProtocol(protocol)
-	if err != nil {
-		return err
-	}
-
+// applyRuleSet programs chains, rules and once-rules from Portmaster's
+// static rule tables (v4rules/v4once/v4chains and their v6 counterparts)
+// against the given NetfilterRunner backend, scoped to family. Each entry
+// is a "table chain arg1 arg2 ..." string, matching iptables-append syntax.
+func applyRuleSet(runner NetfilterRunner, family Family, rules, once, chains []string) error {
 	for _, chain := range chains {
-		splittedRule := strings.Split(chain, " ")
-		if err = tbls.ClearChain(splittedRule[0], splittedRule[1]); err != nil {
+		parts := strings.Split(chain, " ")
+		if err := runner.EnsureChain(family, parts[0], parts[1]); err != nil {
 			return err
 		}
 	}
 
 	for _, rule := range rules {
-		splittedRule := strings.Split(rule, " ")
-		if err = tbls.Append(splittedRule[0], splittedRule[1], splittedRule[2:]...); err != nil {
+		parts := strings.Split(rule, " ")
+		if err := runner.AppendRule(family, parts[0], parts[1], parts[2:]...); err != nil {
 			return err
 		}
 	}
 
 	for _, rule := range once {
-		splittedRule := strings.Split(rule, " ")
-		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			if err = tbls.Insert(splittedRule[0], splittedRule[1], 1, splittedRule[2:]...); err != nil {
+		parts := strings.Split(rule, " ")
+		if mark, protocol, to, ok := parseDNATRule(parts[2:]); ok {
+			if err := runner.AddNATRedirect(mark, protocol, to); err != nil {
 				return err
 			}
+			continue
+		}
+
+		if err := runner.InsertOnce(family, parts[0], parts[1], parts[2:]...); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func deactivateIPTables(protocol iptables.Protocol, rules, chains []string) error {
-	tbls, err := iptables.NewWithProtocol(protocol)
-	if err != nil {
-		return err
-	}
-
-	var multierr *multierror.Error
+// teardownRuleSet reverses applyRuleSet: it removes the once-rules and then
+// clears and deletes the chains they and the regular rules live in, scoped
+// to family.
+func teardownRuleSet(runner NetfilterRunner, family Family, once, chains []string) error {
+	var result *multierror.Error
 
-	for _, rule := range rules {
-		splittedRule := strings.Split(rule, " ")
-		ok, err := tbls.Exists(splittedRule[0], splittedRule[1], splittedRule[2:]...)
-		if err != nil {
-			multierr = multierror.Append(multierr, err)
-		}
-		if ok {
-			if err = tbls.Delete(splittedRule[0], splittedRule[1], splittedRule[2:]...); err != nil {
-				multierr = multierror.Append(multierr, err)
+	for _, rule := range once {
+		parts := strings.Split(rule, " ")
+		if mark, protocol, to, ok := parseDNATRule(parts[2:]); ok {
+			// DNAT redirects were installed via AddNATRedirect, not
+			// InsertOnce, so they must be removed the same specific way -
+			// never by clearing the whole nat/OUTPUT chain, which on the
+			// iptables backend is the kernel's shared built-in chain (also
+			// used by Docker, libvirt, ...), not something Portmaster owns.
+			if err := runner.RemoveNATRedirect(mark, protocol, to); err != nil {
+				result = multierror.Append(result, err)
 			}
+			continue
+		}
+		if err := runner.DeleteRule(family, parts[0], parts[1], parts[2:]...); err != nil {
+			result = multierror.Append(result, err)
 		}
 	}
 
 	for _, chain := range chains {
-		splittedRule := strings.Split(chain, " ")
-		if err = tbls.ClearChain(splittedRule[0], splittedRule[1]); err != nil {
-			multierr = multierror.Append(multierr, err)
-		}
-		if err = tbls.DeleteChain(splittedRule[0], splittedRule[1]); err != nil {
-			multierr = multierror.Append(multierr, err)
+		parts := strings.Split(chain, " ")
+		if err := runner.ClearAndDeleteChain(family, parts[0], parts[1]); err != nil {
+			result = multierror.Append(result, err)
 		}
 	}
 
-	return multierr.ErrorOrNil()
+	// On backends that hook their own dedicated base chains (nftables'
+	// "mangle-output"/"mangle-input"/"nat-output", as opposed to iptables
+	// which only ever jumps out of or redirects within the kernel's shared
+	// built-in OUTPUT/INPUT/nat-OUTPUT chains via the per-rule DeleteRule
+	// and RemoveNATRedirect calls above), remove those base chains too.
+	if err := runner.TeardownBaseChains(family); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result.ErrorOrNil()
+}
+
+// parseDNATRule recognizes the "-m mark --mark <n> -p <proto> -j DNAT --to
+// <addr>" once-rules and extracts their mark, protocol and redirect target,
+// so they can be installed via NetfilterRunner.AddNATRedirect instead of a
+// raw InsertOnce.
+func parseDNATRule(spec []string) (mark int, protocol, to string, ok bool) {
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case "--mark":
+			if i+1 < len(spec) {
+				if v, err := strconv.Atoi(spec[i+1]); err == nil {
+					mark = v
+				}
+			}
+		case "-p":
+			if i+1 < len(spec) {
+				protocol = spec[i+1]
+			}
+		case "--to":
+			if i+1 < len(spec) {
+				to = spec[i+1]
+			}
+		}
+	}
+	ok = protocol != "" && to != ""
+	return
 }
 
 // StartNfqueueInterception starts the nfqueue interception.
@@ -239,12 +282,33 @@ func StartNfqueueInterception() (err error) {
 		}
 	}
 
+	netfilter, err = newNetfilterRunner()
+	if err != nil {
+		return fmt.Errorf("could not select netfilter backend: %w", err)
+	}
+
+	// Clean up any chains/rules left behind by a previous, uncleanly
+	// terminated run before applying the current rule set.
+	if err = registerState(); err != nil {
+		return fmt.Errorf("could not recover leftover interception state: %w", err)
+	}
+
 	err = activateNfqueueFirewall()
 	if err != nil {
 		_ = Stop()
 		return fmt.Errorf("could not initialize nfqueue: %s", err)
 	}
 
+	if err = saveState(netfilter); err != nil {
+		log.Warningf("interception: failed to persist interception state: %s", err)
+	}
+
+	firewalld, err = startFirewalldCooperation()
+	if err != nil {
+		log.Warningf("interception: failed to set up firewalld cooperation: %s", err)
+		err = nil
+	}
+
 	out4Queue, err = nfQueueFactory(17040, false)
 	if err != nil {
 		_ = Stop()
@@ -274,6 +338,9 @@ func StartNfqueueInterception() (err error) {
 func StopNfqueueInterception() error {
 	defer close(shutdownSignal)
 
+	firewalld.stop()
+	firewalld = nil
+
 	if out4Queue != nil {
 		out4Queue.Destroy()
 	}
@@ -292,6 +359,13 @@ func StopNfqueueInterception() error {
 		return fmt.Errorf("interception: error while deactivating nfqueue: %s", err)
 	}
 
+	// Only forget the recorded state once teardown actually succeeded, so a
+	// crash between DeactivateNfqueueFirewall and here still gets cleaned up
+	// on the next start.
+	if err := clearState(); err != nil {
+		log.Warningf("interception: failed to clear interception state: %s", err)
+	}
+
 	return nil
 }
 
@@ -302,16 +376,41 @@ func handleInterception() {
 			return
 		case pkt := <-out4Queue.PacketChannel():
 			pkt.SetOutbound()
+			tagInterface(pkt)
 			Packets <- pkt
 		case pkt := <-in4Queue.PacketChannel():
 			pkt.SetInbound()
+			tagInterface(pkt)
 			Packets <- pkt
 		case pkt := <-out6Queue.PacketChannel():
 			pkt.SetOutbound()
+			tagInterface(pkt)
 			Packets <- pkt
 		case pkt := <-in6Queue.PacketChannel():
 			pkt.SetInbound()
+			tagInterface(pkt)
 			Packets <- pkt
 		}
 	}
 }
+
+// tagInterface resolves the name of the interface pkt was captured on and
+// populates it on pkt.Info(), so later stages (eg. the firewall package's
+// per-interface policies) can match on it without re-deriving it themselves.
+//
+// This relies on the nfqueue/nfqexp backends carrying the kernel's
+// nfqnl_attr ifindex (in or out device) through to packet.Packet.IfIndex().
+func tagInterface(pkt packet.Packet) {
+	idx := pkt.IfIndex()
+	if idx == 0 {
+		return
+	}
+
+	iface, err := net.InterfaceByIndex(idx)
+	if err != nil {
+		log.Debugf("interception: failed to resolve interface %d: %s", idx, err)
+		return
+	}
+
+	pkt.Info().Interface = iface.Name
+}
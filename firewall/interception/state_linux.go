@@ -0,0 +1,157 @@
+package interception
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/state"
+)
+
+// stateComponent is the name interception registers itself under with the
+// shared state package.
+const stateComponent = "interception"
+
+// interceptionState is the persisted description of everything
+// activateNfqueueFirewall applied to the kernel, so it can be undone again
+// on the next start, even by a different backend, in case Portmaster was
+// killed before StopNfqueueInterception got a chance to run.
+type interceptionState struct {
+	// Backend is the kind of NetfilterRunner ("iptables" or "nftables")
+	// that produced this state.
+	Backend string `json:"backend"`
+
+	Chains []chainRef `json:"chains"`
+	Once   []ruleRef  `json:"once"`
+}
+
+type chainRef struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+}
+
+type ruleRef struct {
+	Table string   `json:"table"`
+	Chain string   `json:"chain"`
+	Spec  []string `json:"spec"`
+}
+
+func backendName(runner NetfilterRunner) string {
+	switch runner.(type) {
+	case *nftablesRunner:
+		return "nftables"
+	default:
+		return "iptables"
+	}
+}
+
+// registerState registers interception with the state package, which
+// immediately cleans up any chains/rules left behind by a previous, unclean
+// shutdown - regardless of which backend produced them.
+func registerState() error {
+	return state.Register(stateComponent, cleanupLeftoverState)
+}
+
+// saveState records the rule set that was just applied, so it can be
+// cleaned up on the next start if this one does not exit cleanly.
+func saveState(runner NetfilterRunner) error {
+	s := interceptionState{
+		Backend: backendName(runner),
+	}
+
+	for _, set := range [][]string{v4chains, v6chains} {
+		for _, chain := range set {
+			parts := strings.Split(chain, " ")
+			s.Chains = append(s.Chains, chainRef{Table: parts[0], Chain: parts[1]})
+		}
+	}
+
+	for _, set := range [][]string{v4once, v6once} {
+		for _, rule := range set {
+			parts := strings.Split(rule, " ")
+			s.Once = append(s.Once, ruleRef{Table: parts[0], Chain: parts[1], Spec: parts[2:]})
+		}
+	}
+
+	return state.Save(stateComponent, s)
+}
+
+// clearState removes the recorded state after StopNfqueueInterception has
+// successfully torn down the rules it describes.
+func clearState() error {
+	return state.Clear(stateComponent)
+}
+
+// cleanupLeftoverState is called by the state package with the payload of a
+// state file left behind by a previous run. It builds whichever backend
+// produced that state - which may differ from the backend this run selected
+// - purely to undo it. Only if that backend cannot be built does it use the
+// current backend instead.
+func cleanupLeftoverState(payload json.RawMessage) error {
+	var s interceptionState
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return fmt.Errorf("failed to decode leftover interception state: %w", err)
+	}
+
+	runners := []NetfilterRunner{}
+
+	if oldRunner, err := runnerForBackend(s.Backend); err != nil {
+		log.Warningf("interception: could not build %s backend to clean up leftover state, trying current backend instead: %s", s.Backend, err)
+		if netfilter != nil {
+			runners = append(runners, netfilter)
+		}
+	} else {
+		runners = append(runners, oldRunner)
+	}
+
+	var result *multierror.Error
+	for _, runner := range runners {
+		// chainRef/ruleRef carry no family tag - saveState records the same
+		// table/chain/spec content once for v4 and once for v6, so clean up
+		// both families for every recorded entry.
+		for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+			for _, rule := range s.Once {
+				if mark, protocol, to, ok := parseDNATRule(rule.Spec); ok {
+					// DNAT redirects were installed via AddNATRedirect, not
+					// InsertOnce - remove them the same specific way. Never
+					// clear/delete the whole nat/OUTPUT chain: on the
+					// iptables backend that is the kernel's shared
+					// built-in chain, and flushing it on every startup
+					// recovery would wipe every other program's DNAT rules
+					// (Docker, libvirt, ...) too.
+					if err := runner.RemoveNATRedirect(mark, protocol, to); err != nil {
+						result = multierror.Append(result, err)
+					}
+					continue
+				}
+				if err := runner.DeleteRule(family, rule.Table, rule.Chain, rule.Spec...); err != nil {
+					result = multierror.Append(result, err)
+				}
+			}
+			for _, chain := range s.Chains {
+				if err := runner.ClearAndDeleteChain(family, chain.Table, chain.Chain); err != nil {
+					result = multierror.Append(result, err)
+				}
+			}
+			if err := runner.TeardownBaseChains(family); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+func runnerForBackend(backend string) (NetfilterRunner, error) {
+	switch backend {
+	case "nftables":
+		return newNftablesRunner()
+	case "iptables":
+		return newIptablesRunner()
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+}
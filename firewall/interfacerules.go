@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/firewall/ifrules"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+// InterfacePolicy is re-exported from the ifrules package so callers only
+// need to import the firewall package.
+type InterfacePolicy = ifrules.Policy
+
+// interfaceRules holds the user-configurable per-interface policies
+// consulted by fastTrackedPermit and initialHandler. It starts out empty:
+// with no policy configured, interface-scoped matching is a no-op and
+// every packet proceeds through the normal decision process exactly as
+// before this feature existed.
+var interfaceRules = ifrules.NewSet()
+
+// SetInterfaceRules replaces the entire interface policy set with rules,
+// keyed by interface-name pattern (eg. "lo", "wg*"). The swap is atomic:
+// packets being classified concurrently see either the old or the new
+// set in full, never a partial one.
+func SetInterfaceRules(rules map[string]InterfacePolicy) error {
+	if err := interfaceRules.Replace(rules); err != nil {
+		return err
+	}
+	bumpVerdictCacheGeneration()
+	return nil
+}
+
+// applyInterfaceVerdict applies policy's DefaultVerdict to pkt.
+func applyInterfaceVerdict(pkt packet.Packet, policy *ifrules.Policy) {
+	var err error
+	switch policy.DefaultVerdict {
+	case network.VerdictBlock:
+		if policy.Permanent {
+			err = pkt.PermanentBlock()
+		} else {
+			err = pkt.Block()
+		}
+	case network.VerdictDrop:
+		if policy.Permanent {
+			err = pkt.PermanentDrop()
+		} else {
+			err = pkt.Drop()
+		}
+	default:
+		if policy.Permanent {
+			err = pkt.PermanentAccept()
+		} else {
+			err = pkt.Accept()
+		}
+	}
+
+	if err != nil {
+		log.Warningf("filter: failed to apply interface policy verdict: %s", err)
+	}
+}
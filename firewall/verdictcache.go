@@ -0,0 +1,326 @@
+package firewall
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portbase/log"
+	"github.com/safing/portmaster/network"
+	"github.com/safing/portmaster/network/packet"
+)
+
+const (
+	defaultVerdictCacheSize = 4096
+	verdictCacheTTL         = 30 * time.Second
+)
+
+var (
+	// verdictCacheGeneration is bumped whenever something that
+	// fastTrackedPermit/DecideOnConnection consult - the fast-track
+	// ruleset or the interface policies - changes, so cached verdicts
+	// computed under the old rules are treated as stale on their next lookup
+	// instead of being actively walked and evicted.
+	verdictCacheGeneration uint64
+
+	verdictCacheHits   = new(uint64)
+	verdictCacheMisses = new(uint64)
+
+	verdictCacheStore = newVerdictCache(defaultVerdictCacheSize)
+)
+
+// bumpVerdictCacheGeneration invalidates every entry currently in the
+// verdict cache. Called whenever a rule change means an already-cached
+// verdict might no longer be correct.
+func bumpVerdictCacheGeneration() {
+	atomic.AddUint64(&verdictCacheGeneration, 1)
+}
+
+// SetVerdictCacheSize resizes the verdict cache to hold at most n entries,
+// evicting the least recently used entries if it is currently larger. An n
+// of zero or less removes the bound: no entry is evicted for size.
+func SetVerdictCacheSize(n int) {
+	verdictCacheStore.resize(n)
+}
+
+// verdictCacheKey is the compact 5-tuple a cached verdict is keyed on. The
+// key itself intentionally stays tuple-only - lookupConnectionByTuple's
+// callers (the ICMP error correlator) only ever have the tuple, never a
+// PID, to look up with. The PID stored on the entry is instead verified
+// separately on every hit in verdictCacheApply, see there.
+type verdictCacheKey struct {
+	protocol packet.IPProtocol
+	srcIP    [16]byte
+	srcPort  uint16
+	dstIP    [16]byte
+	dstPort  uint16
+}
+
+func newVerdictCacheKey(meta *packet.Info) verdictCacheKey {
+	var key verdictCacheKey
+	key.protocol = meta.Protocol
+	key.srcPort = meta.SrcPort
+	key.dstPort = meta.DstPort
+	copy(key.srcIP[:], meta.Src.To16())
+	copy(key.dstIP[:], meta.Dst.To16())
+	return key
+}
+
+// verdictCacheEntry is what a hit in the verdict cache resolves to.
+type verdictCacheEntry struct {
+	verdict    network.Verdict
+	reason     string
+	permanent  bool
+	pid        int
+	connID     string
+	generation uint64
+	expires    time.Time
+	hits       uint64
+}
+
+func (e *verdictCacheEntry) stale() bool {
+	return e.generation != atomic.LoadUint64(&verdictCacheGeneration) || time.Now().After(e.expires)
+}
+
+// verdictCache is a bounded LRU cache of verdictCacheEntry, evicted by size
+// (oldest entry dropped once capacity is exceeded), lazily by staleness
+// (checked on lookup, see verdictCacheEntry.stale), and eagerly as soon as
+// the connection it was cached for is finalized (see evictByConnID).
+type verdictCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[verdictCacheKey]*list.Element
+	byConnID map[string]verdictCacheKey
+}
+
+type verdictCacheListItem struct {
+	key   verdictCacheKey
+	entry *verdictCacheEntry
+}
+
+func newVerdictCache(capacity int) *verdictCache {
+	return &verdictCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[verdictCacheKey]*list.Element),
+		byConnID: make(map[string]verdictCacheKey),
+	}
+}
+
+func (c *verdictCache) get(key verdictCacheKey) (*verdictCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(verdictCacheMisses, 1)
+		return nil, false
+	}
+
+	item := el.Value.(*verdictCacheListItem) //nolint:forcetypeassert
+	if item.entry.stale() {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		delete(c.byConnID, item.entry.connID)
+		atomic.AddUint64(verdictCacheMisses, 1)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	item.entry.hits++
+	atomic.AddUint64(verdictCacheHits, 1)
+	return item.entry, true
+}
+
+func (c *verdictCache) set(key verdictCacheKey, entry *verdictCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry.connID != "" {
+		c.byConnID[entry.connID] = key
+	}
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*verdictCacheListItem).entry = entry //nolint:forcetypeassert
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&verdictCacheListItem{key: key, entry: entry})
+	c.items[key] = el
+	c.evictOverCapacityLocked()
+}
+
+// evictByConnID removes the cache entry belonging to connID, if any. Called
+// when the underlying network.Connection is finalized, so a verdict from a
+// connection that no longer exists can never be served to whatever reuses
+// its 5-tuple next, instead of waiting out the remainder of the TTL.
+func (c *verdictCache) evictByConnID(connID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.byConnID[connID]
+	if !ok {
+		return
+	}
+	delete(c.byConnID, connID)
+
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*verdictCacheListItem) //nolint:forcetypeassert
+		if item.entry.connID == connID {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+func (c *verdictCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.evictOverCapacityLocked()
+}
+
+func (c *verdictCache) evictOverCapacityLocked() {
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			return
+		}
+		item := oldest.Value.(*verdictCacheListItem) //nolint:forcetypeassert
+		c.ll.Remove(oldest)
+		delete(c.items, item.key)
+		delete(c.byConnID, item.entry.connID)
+	}
+}
+
+// verdictCacheApply looks up a cached verdict for pkt's flow and, if one is
+// found and still fresh, applies it directly. This is the fast path
+// handlePacket takes to skip getConnection, DecideOnConnection and the
+// per-packet tracer allocation entirely for a flow that already resolved.
+// It reports whether pkt was handled.
+func verdictCacheApply(pkt packet.Packet) bool {
+	entry, ok := verdictCacheStore.get(newVerdictCacheKey(pkt.Info()))
+	if !ok {
+		return false
+	}
+
+	// An ephemeral 5-tuple can be reused by a different process within the
+	// cache's TTL. Since the key itself is tuple-only (see
+	// verdictCacheKey), compare the entry's PID with the one
+	// network.LookupPacketPID reports for this packet before trusting it.
+	// LookupPacketPID reads the PID of the connection currently tracked
+	// under the packet's connection ID, so a reused tuple is only caught
+	// once that connection carries a different PID than the entry. If no
+	// PID can be resolved, fall back to the normal decision path.
+	if pid, ok := network.LookupPacketPID(pkt); !ok || pid != entry.pid {
+		return false
+	}
+
+	var err error
+	switch entry.verdict {
+	case network.VerdictAccept:
+		if entry.permanent {
+			err = pkt.PermanentAccept()
+		} else {
+			err = pkt.Accept()
+		}
+	case network.VerdictBlock:
+		if entry.permanent {
+			err = pkt.PermanentBlock()
+		} else {
+			err = pkt.Block()
+		}
+	case network.VerdictDrop:
+		if entry.permanent {
+			err = pkt.PermanentDrop()
+		} else {
+			err = pkt.Drop()
+		}
+	default:
+		// Reroute and undecided verdicts are never cached (see
+		// cacheVerdict), so this is unreachable in practice.
+		return false
+	}
+
+	if err != nil {
+		log.Warningf("filter: failed to apply cached verdict: %s", err)
+	}
+	return true
+}
+
+// cacheVerdict remembers verdict for conn/pkt's flow, so that later packets
+// of the same flow can take the verdictCacheApply fast path. Only the
+// terminal, packet-shape verdicts are cached: a reroute or an undecided
+// verdict says nothing about the flow's next packet.
+func cacheVerdict(conn *network.Connection, pkt packet.Packet, verdict network.Verdict) {
+	switch verdict {
+	case network.VerdictAccept, network.VerdictBlock, network.VerdictDrop:
+	default:
+		return
+	}
+
+	verdictCacheStore.set(newVerdictCacheKey(pkt.Info()), &verdictCacheEntry{
+		verdict:    verdict,
+		reason:     conn.Reason.Msg,
+		permanent:  conn.VerdictPermanent,
+		pid:        conn.Process().Pid,
+		connID:     conn.ID,
+		generation: atomic.LoadUint64(&verdictCacheGeneration),
+		expires:    time.Now().Add(verdictCacheTTL),
+	})
+
+	registerVerdictCacheEviction(conn)
+}
+
+// verdictCacheEvictionRegistered tracks which connections already have an
+// eviction callback registered, so a flow with many packets (and therefore
+// many cacheVerdict calls) only ever registers one.
+var (
+	verdictCacheEvictionRegistered   = make(map[string]bool)
+	verdictCacheEvictionRegisteredMu sync.Mutex
+)
+
+// registerVerdictCacheEviction arranges for conn's verdict cache entry to be
+// dropped as soon as conn is finalized (closed, or re-decided out-of-band,
+// eg. via a manual block from the UI), instead of being served for up to
+// verdictCacheTTL after it stops being accurate.
+func registerVerdictCacheEviction(conn *network.Connection) {
+	verdictCacheEvictionRegisteredMu.Lock()
+	defer verdictCacheEvictionRegisteredMu.Unlock()
+
+	if verdictCacheEvictionRegistered[conn.ID] {
+		return
+	}
+	verdictCacheEvictionRegistered[conn.ID] = true
+
+	connID := conn.ID
+	conn.AddFinalizeCallback(func() {
+		verdictCacheStore.evictByConnID(connID)
+
+		verdictCacheEvictionRegisteredMu.Lock()
+		delete(verdictCacheEvictionRegistered, connID)
+		verdictCacheEvictionRegisteredMu.Unlock()
+	})
+}
+
+// lookupConnectionByTuple returns the connection currently cached for the
+// given 5-tuple, if any. This only sees flows that have already gone
+// through cacheVerdict at least once; it exists for callers - such as the
+// ICMP error correlator - that need a cheap reverse lookup and can tolerate
+// an occasional miss on a flow the cache hasn't learned about yet.
+func lookupConnectionByTuple(protocol packet.IPProtocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) (*network.Connection, bool) {
+	key := verdictCacheKey{protocol: protocol, srcPort: srcPort, dstPort: dstPort}
+	copy(key.srcIP[:], srcIP.To16())
+	copy(key.dstIP[:], dstIP.To16())
+
+	entry, ok := verdictCacheStore.get(key)
+	if !ok || entry.connID == "" {
+		return nil, false
+	}
+	return network.GetConnection(entry.connID)
+}
@@ -0,0 +1,81 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerdictCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newVerdictCache(2)
+
+	keyA := verdictCacheKey{srcPort: 1}
+	keyB := verdictCacheKey{srcPort: 2}
+	keyC := verdictCacheKey{srcPort: 3}
+
+	entry := func() *verdictCacheEntry {
+		return &verdictCacheEntry{expires: time.Now().Add(time.Minute)}
+	}
+
+	c.set(keyA, entry())
+	c.set(keyB, entry())
+
+	// Touch A so B becomes the least recently used entry.
+	if _, ok := c.get(keyA); !ok {
+		t.Fatal("expected keyA to be present")
+	}
+
+	c.set(keyC, entry())
+
+	if _, ok := c.get(keyB); ok {
+		t.Error("expected keyB to have been evicted as least recently used")
+	}
+	if _, ok := c.get(keyA); !ok {
+		t.Error("expected keyA to still be cached")
+	}
+	if _, ok := c.get(keyC); !ok {
+		t.Error("expected keyC to be cached")
+	}
+}
+
+func TestVerdictCacheEntryStaleness(t *testing.T) {
+	key := verdictCacheKey{srcPort: 1}
+	c := newVerdictCache(10)
+
+	c.set(key, &verdictCacheEntry{
+		expires:    time.Now().Add(time.Minute),
+		generation: 0,
+	})
+	if _, ok := c.get(key); !ok {
+		t.Fatal("expected fresh entry to be a hit")
+	}
+
+	c.set(key, &verdictCacheEntry{
+		expires:    time.Now().Add(-time.Second),
+		generation: 0,
+	})
+	if _, ok := c.get(key); ok {
+		t.Error("expected expired entry to be treated as a miss")
+	}
+
+	c.set(key, &verdictCacheEntry{
+		expires:    time.Now().Add(time.Minute),
+		generation: 1,
+	})
+	verdictCacheGeneration = 2
+	defer func() { verdictCacheGeneration = 0 }()
+	if _, ok := c.get(key); ok {
+		t.Error("expected entry from a stale generation to be treated as a miss")
+	}
+}
+
+func TestVerdictCacheResize(t *testing.T) {
+	c := newVerdictCache(10)
+	for i := 0; i < 5; i++ {
+		c.set(verdictCacheKey{srcPort: uint16(i)}, &verdictCacheEntry{expires: time.Now().Add(time.Minute)})
+	}
+
+	c.resize(2)
+	if c.ll.Len() != 2 {
+		t.Fatalf("expected resize to shrink the cache to 2 entries, got %d", c.ll.Len())
+	}
+}
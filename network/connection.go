@@ -0,0 +1,284 @@
+// Package network tracks connections as they are seen by the firewall,
+// carrying the verdict the decision process has reached (or is still
+// reaching) for each. It does not resolve which local process owns a
+// connection: NewConnectionFromFirstPacket leaves its Process with a zero
+// Pid.
+package network
+
+import (
+	"sync"
+
+	"github.com/safing/portmaster/network/packet"
+)
+
+// Verdict is a decision on how to handle a connection or packet. Verdicts
+// are ordered: a lower verdict may be upgraded to a higher one (eg. an
+// Undecided connection may still be Blocked), but never downgraded once
+// decided - see issueVerdict's use of Connection.Verdict as a floor.
+type Verdict int8
+
+// Verdicts the firewall decision process may reach for a connection.
+const (
+	VerdictUndecided Verdict = iota
+	VerdictAccept
+	VerdictBlock
+	VerdictDrop
+	VerdictRerouteToNameserver
+	VerdictRerouteToTunnel
+	VerdictFailed
+)
+
+// String returns the verdict's name, as used in log messages and capture
+// frame metadata.
+func (v Verdict) String() string {
+	switch v {
+	case VerdictUndecided:
+		return "undecided"
+	case VerdictAccept:
+		return "accept"
+	case VerdictBlock:
+		return "block"
+	case VerdictDrop:
+		return "drop"
+	case VerdictRerouteToNameserver:
+		return "reroute-to-nameserver"
+	case VerdictRerouteToTunnel:
+		return "reroute-to-tunnel"
+	case VerdictFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// IPScope classifies how far an IP address reaches, eg. whether it is
+// globally routable.
+type IPScope int8
+
+// Scopes an Entity's IP address may fall into.
+const (
+	ScopeInvalid IPScope = iota
+	ScopeHostLocal
+	ScopeLinkLocal
+	ScopeSiteLocal
+	ScopeGlobal
+)
+
+// IsGlobal reports whether the scope is globally routable, ie. whether a
+// connection with this scope is a candidate for tunneling.
+func (s IPScope) IsGlobal() bool {
+	return s == ScopeGlobal
+}
+
+// Entity describes the remote side of a connection: the identity the
+// decision process and tunneling reason about, as opposed to the raw
+// packet tuple.
+type Entity struct {
+	Protocol packet.IPProtocol
+	IPScope  IPScope
+	Domain   string
+}
+
+// Reason records why a connection was given its current verdict.
+type Reason struct {
+	Msg string
+}
+
+// Process identifies the local process a connection belongs to.
+type Process struct {
+	Pid int
+}
+
+// ProcessContext carries the process attributes worth keeping on the
+// connection after the owning Process may have exited, eg. for capture
+// metadata and the UI.
+type ProcessContext struct {
+	ProfileID string
+}
+
+// FirewallHandler decides the verdict for a connection's packets. It is
+// swapped out as a connection moves through the decision process, see
+// Connection.SetFirewallHandler.
+type FirewallHandler func(conn *Connection, pkt packet.Packet)
+
+// Connection is a tracked network connection, together with the verdict
+// the firewall has reached (or is still reaching) for it.
+type Connection struct {
+	sync.Mutex
+
+	ID string
+
+	Verdict          Verdict
+	VerdictPermanent bool
+	Reason           Reason
+
+	Entity *Entity
+
+	Inbound    bool
+	Internal   bool
+	Inspecting bool
+
+	LocalPort uint16
+
+	ProcessContext ProcessContext
+
+	process *Process
+
+	firewallHandler FirewallHandler
+
+	finalizeOnce sync.Once
+	finalizeCBs  []func()
+}
+
+// Process returns the local process this connection belongs to.
+func (conn *Connection) Process() *Process {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.process
+}
+
+// Accept marks the connection as accepted for the given reason. Like the
+// rest of the decision process, it does not itself apply the verdict to
+// any in-flight packet - the caller still issues that via the firewall
+// handler chain.
+func (conn *Connection) Accept(reason string, optionKey string) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.Verdict = VerdictAccept
+	conn.Reason.Msg = reason
+}
+
+// SetVerdict sets the connection's verdict and the reason for it.
+func (conn *Connection) SetVerdict(verdict Verdict, reason string, reasonID string, ctx interface{}) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.Verdict = verdict
+	conn.Reason.Msg = reason
+}
+
+// SetFirewallHandler sets the handler that decides the verdict for this
+// connection's subsequent packets, taking over from whatever handler (if
+// any) was set before.
+func (conn *Connection) SetFirewallHandler(handler FirewallHandler) {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.firewallHandler = handler
+}
+
+// StopFirewallHandler clears the connection's firewall handler, marking
+// the decision process as finished for this connection.
+func (conn *Connection) StopFirewallHandler() {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.firewallHandler = nil
+}
+
+// HandlePacket runs pkt through the connection's current firewall handler.
+func (conn *Connection) HandlePacket(pkt packet.Packet) {
+	conn.Lock()
+	handler := conn.firewallHandler
+	conn.Unlock()
+
+	if handler != nil {
+		handler(conn, pkt)
+	}
+}
+
+// SaveWhenFinished does nothing: this package keeps connections in memory
+// only and records no persistence flag.
+func (conn *Connection) SaveWhenFinished() {
+	// Kept so that callers that expect the method to exist keep working.
+}
+
+// Close finalizes the connection, running any callbacks registered via
+// AddFinalizeCallback exactly once.
+func (conn *Connection) Close() error {
+	conn.finalizeOnce.Do(func() {
+		conn.Lock()
+		cbs := conn.finalizeCBs
+		conn.finalizeCBs = nil
+		conn.Unlock()
+
+		for _, cb := range cbs {
+			cb()
+		}
+	})
+	return nil
+}
+
+// AddFinalizeCallback registers fn to run once the connection is closed
+// (see Close). If the connection has already been closed, fn is never
+// called. Used eg. by the verdict cache to evict a connection's entry
+// as soon as it stops being authoritative, instead of waiting out its TTL.
+func (conn *Connection) AddFinalizeCallback(fn func()) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.finalizeCBs = append(conn.finalizeCBs, fn)
+}
+
+var (
+	connectionsLock sync.Mutex
+	connections     = make(map[string]*Connection)
+
+	defaultFirewallHandler FirewallHandler
+)
+
+// SetDefaultFirewallHandler sets the handler assigned to a connection
+// before the decision process has run for it at all.
+func SetDefaultFirewallHandler(handler FirewallHandler) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	defaultFirewallHandler = handler
+}
+
+// GetConnection returns the currently tracked connection with the given
+// ID, if any.
+func GetConnection(id string) (*Connection, bool) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	conn, ok := connections[id]
+	return conn, ok
+}
+
+// NewConnectionFromFirstPacket creates and registers a new Connection for
+// the flow pkt belongs to, seeding it with pkt's metadata.
+func NewConnectionFromFirstPacket(pkt packet.Packet) *Connection {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	meta := pkt.Info()
+	conn := &Connection{
+		ID:              pkt.GetConnectionID(),
+		Inbound:         pkt.IsInbound(),
+		Inspecting:      true,
+		Entity:          &Entity{Protocol: meta.Protocol},
+		process:         &Process{},
+		firewallHandler: defaultFirewallHandler,
+	}
+	if conn.Inbound {
+		conn.LocalPort = meta.DstPort
+	} else {
+		conn.LocalPort = meta.SrcPort
+	}
+
+	connections[conn.ID] = conn
+	return conn
+}
+
+// LookupPacketPID returns the PID of the process recorded on the connection
+// currently tracked under pkt's connection ID, without building a new
+// Connection for it. It does not consult the system's socket table. It is
+// used to revalidate a verdict cache hit, see verdictCacheApply. It reports
+// false if no connection is tracked for pkt or it has no process.
+func LookupPacketPID(pkt packet.Packet) (int, bool) {
+	if conn, ok := GetConnection(pkt.GetConnectionID()); ok {
+		if proc := conn.Process(); proc != nil {
+			return proc.Pid, true
+		}
+	}
+	return 0, false
+}
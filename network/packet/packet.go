@@ -0,0 +1,89 @@
+// Package packet defines the representation of a single intercepted packet
+// that the firewall decision process and its interception backends operate
+// on, independent of whichever kernel interface (NFQUEUE, divert, ...)
+// captured it.
+package packet
+
+import (
+	"context"
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// IPProtocol identifies the transport (or ICMP) protocol of a packet.
+type IPProtocol uint8
+
+// Protocols handled by the firewall's fast-track and decision paths.
+const (
+	TCP    IPProtocol = 6
+	UDP    IPProtocol = 17
+	ICMP   IPProtocol = 1
+	ICMPv6 IPProtocol = 58
+)
+
+// Info holds the packet metadata the firewall decision process and fast
+// track rules match against. It is intentionally decoupled from the raw
+// packet bytes, so it can be built once per packet and consulted repeatedly
+// without re-parsing.
+type Info struct {
+	Protocol IPProtocol
+	Src      net.IP
+	Dst      net.IP
+	SrcPort  uint16
+	DstPort  uint16
+
+	// Interface is the name of the network interface the packet arrived on
+	// or is about to be sent out of, as resolved from the kernel-reported
+	// ifindex. It is populated lazily by the interception layer (see
+	// interception.tagInterface) and is empty until then.
+	Interface string
+}
+
+// Packet is a single intercepted packet, along with the verdict methods
+// that apply to it (and, depending on the interception backend, to every
+// later packet of the same connection).
+type Packet interface {
+	// Info returns the packet's parsed metadata.
+	Info() *Info
+	// Layers returns the packet's decoded layers, parsing them from the raw
+	// data on first use.
+	Layers() gopacket.Packet
+	// LoadPacketData ensures the packet's raw data and layers are available,
+	// fetching them from the interception backend if they haven't been
+	// already. Some interception backends hand over metadata-only packets
+	// until this is called.
+	LoadPacketData() error
+
+	// GetConnectionID returns the identifier of the connection this packet
+	// belongs to, used to look up or create its *network.Connection.
+	GetConnectionID() string
+
+	IsInbound() bool
+	IsOutbound() bool
+	SetInbound()
+	SetOutbound()
+
+	// IfIndex returns the kernel interface index the packet was captured
+	// on or off, or 0 if the interception backend didn't report one.
+	IfIndex() int
+
+	// FastTrackedByIntegration reports whether the OS integration (rather
+	// than Portmaster's own fast-track rules) already decided this packet
+	// should be let through.
+	FastTrackedByIntegration() bool
+
+	Accept() error
+	Block() error
+	Drop() error
+	PermanentAccept() error
+	PermanentBlock() error
+	PermanentDrop() error
+	RerouteToNameserver() error
+	RerouteToTunnel() error
+
+	Ctx() context.Context
+	SetCtx(ctx context.Context)
+
+	String() string
+}
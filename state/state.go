@@ -0,0 +1,133 @@
+// Package state provides a small, file-backed registry that lets
+// kernel-touching subsystems (packet interception, DNS redirection, ...)
+// record the exact changes they applied to the system, so that a future
+// start of the process - after a crash or `kill -9` skipped the subsystem's
+// own Stop() - can find and undo them before applying a fresh set of
+// changes. This mirrors how netbird's statemanager package lets independent
+// components clean up after themselves on an unclean shutdown.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/safing/portbase/dataroot"
+	"github.com/safing/portbase/log"
+)
+
+// CleanupFunc undoes whatever was described by a previously saved state
+// payload. It is called with the raw JSON payload as it was passed to Save,
+// so each component can decode it into its own type.
+type CleanupFunc func(payload json.RawMessage) error
+
+// envelope is the on-disk format shared by all components.
+type envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+const currentSchemaVersion = 1
+
+var (
+	mu       sync.Mutex
+	registry = make(map[string]CleanupFunc)
+)
+
+// Register records the cleanup function for the given component and
+// immediately recovers any state left behind by a previous, uncleanly
+// terminated run: if a state file exists for component, cleanup is called
+// with its payload, and the file is only removed once cleanup returns
+// without error.
+//
+// Register should be called once, early during a component's own Start(),
+// before it applies any new state of its own.
+func Register(component string, cleanup CleanupFunc) error {
+	mu.Lock()
+	registry[component] = cleanup
+	mu.Unlock()
+
+	return recover(component, cleanup)
+}
+
+// Save persists payload as the current state for component, overwriting any
+// previous state. Components should call Save after successfully applying
+// a change, so that Register can find and undo it on the next start should
+// the component not get a chance to call Clear.
+func Save(component string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("state: failed to marshal state for %s: %w", component, err)
+	}
+
+	env := envelope{
+		SchemaVersion: currentSchemaVersion,
+		Payload:       raw,
+	}
+
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return fmt.Errorf("state: failed to marshal state envelope for %s: %w", component, err)
+	}
+
+	dir := dataroot.Root().ChildDir("state", 0o0700)
+	if err := dir.Ensure(); err != nil {
+		return fmt.Errorf("state: failed to create state dir: %w", err)
+	}
+
+	path := filepath.Join(dir.Path, component+".json")
+	if err := os.WriteFile(path, data, 0o0600); err != nil {
+		return fmt.Errorf("state: failed to write state file for %s: %w", component, err)
+	}
+
+	return nil
+}
+
+// Clear removes the persisted state for component. Components should call
+// this from their own Stop(), once they have reverted the changes described
+// by the last Save, so Register does not attempt to clean them up again on
+// the next start.
+func Clear(component string) error {
+	dir := dataroot.Root().ChildDir("state", 0o0700)
+	path := filepath.Join(dir.Path, component+".json")
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("state: failed to remove state file for %s: %w", component, err)
+	}
+	return nil
+}
+
+// recover loads and processes any pre-existing state file for component.
+func recover(component string, cleanup CleanupFunc) error {
+	dir := dataroot.Root().ChildDir("state", 0o0700)
+	path := filepath.Join(dir.Path, component+".json")
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("state: failed to read state file for %s: %w", component, err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		log.Warningf("state: state file for %s is corrupt, discarding: %s", component, err)
+		return os.Remove(path)
+	}
+
+	log.Infof("state: found leftover state for %s from a previous run, cleaning up", component)
+	if err := cleanup(env.Payload); err != nil {
+		return fmt.Errorf("state: failed to clean up leftover state for %s: %w", component, err)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("state: failed to remove state file for %s after cleanup: %w", component, err)
+	}
+
+	log.Infof("state: cleaned up leftover state for %s", component)
+	return nil
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/safing/portbase/dataroot"
+)
+
+type testState struct {
+	Chains []string `json:"chains"`
+}
+
+func TestMain(m *testing.M) {
+	tmpDir, err := os.MkdirTemp("", "portmaster-state-test-")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := dataroot.Initialize(tmpDir, 0o0755); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(tmpDir)
+	os.Exit(code)
+}
+
+func TestRegisterCleansUpStaleState(t *testing.T) {
+	const component = "test-component"
+
+	// Simulate a previous, uncleanly terminated run by saving state and
+	// never calling Clear.
+	saved := testState{Chains: []string{"mangle C170", "filter C17"}}
+	if err := Save(component, saved); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+
+	var cleaned testState
+	cleanupCalled := false
+	cleanup := func(payload json.RawMessage) error {
+		cleanupCalled = true
+		return json.Unmarshal(payload, &cleaned)
+	}
+
+	if err := Register(component, cleanup); err != nil {
+		t.Fatalf("Register returned error: %s", err)
+	}
+
+	if !cleanupCalled {
+		t.Fatal("expected cleanup to be called for stale state")
+	}
+	if len(cleaned.Chains) != len(saved.Chains) {
+		t.Fatalf("cleanup did not receive the expected payload: got %+v", cleaned)
+	}
+
+	// The state file must be gone after a successful cleanup, so a second
+	// Register call for the same component finds nothing to do.
+	cleanupCalled = false
+	if err := Register(component, cleanup); err != nil {
+		t.Fatalf("second Register returned error: %s", err)
+	}
+	if cleanupCalled {
+		t.Fatal("cleanup should not be called again once state was removed")
+	}
+}
+
+func TestClearRemovesCurrentState(t *testing.T) {
+	const component = "test-component-clear"
+
+	if err := Save(component, testState{Chains: []string{"filter C17"}}); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+
+	if err := Clear(component); err != nil {
+		t.Fatalf("failed to clear state: %s", err)
+	}
+
+	cleanupCalled := false
+	err := Register(component, func(payload json.RawMessage) error {
+		cleanupCalled = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Register returned error: %s", err)
+	}
+	if cleanupCalled {
+		t.Fatal("cleanup should not be called after Clear removed the state")
+	}
+}